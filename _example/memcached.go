@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"net"
-	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
@@ -94,24 +92,7 @@ func (m MemcachedPlugin) FetchMetrics() (map[string]interface{}, error) {
 }
 
 func (m MemcachedPlugin) ParseStats(conn io.Reader) (map[string]interface{}, error) {
-	scanner := bufio.NewScanner(conn)
-	stat := make(map[string]interface{})
-
-	for scanner.Scan() {
-		s := scanner.Text()
-		if s == "END" {
-			return stat, nil
-		}
-
-		res := strings.Split(s, " ")
-		if res[0] == "STAT" {
-			stat[res[1]] = res[2]
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return stat, err
-	}
-	return nil, nil
+	return mp.MemcachedStats.Parse(conn)
 }
 
 func (m MemcachedPlugin) GraphDefinition() map[string]mp.Graphs {
@@ -121,14 +102,14 @@ func (m MemcachedPlugin) GraphDefinition() map[string]mp.Graphs {
 func main() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "11211", "Port")
-	optTempfile := flag.String("tempfile", "", "Temp file name")
+	opts := mp.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	var memcached MemcachedPlugin
 
 	memcached.Target = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	helper := mp.NewMackerelPlugin(memcached)
-	helper.Tempfile = *optTempfile
+	opts.Apply(&helper)
 
 	helper.Run()
 }
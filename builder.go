@@ -0,0 +1,219 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// MetricOption sets an optional field of Metrics in GraphBuilder.
+type MetricOption func(m *Metrics)
+
+// WithLabel sets Label of the metric.
+func WithLabel(label string) MetricOption {
+	return func(m *Metrics) { m.Label = label }
+}
+
+// WithScale sets Scale of the metric.
+func WithScale(scale float64) MetricOption {
+	return func(m *Metrics) { m.Scale = scale }
+}
+
+// WithValueFormat sets ValueFormat of the metric.
+func WithValueFormat(format ValueFormat) MetricOption {
+	return func(m *Metrics) { m.ValueFormat = format }
+}
+
+// WithDivisor sets Divisor of the metric.
+func WithDivisor(divisor float64) MetricOption {
+	return func(m *Metrics) { m.Divisor = divisor }
+}
+
+// WithOffset sets Offset of the metric.
+func WithOffset(offset float64) MetricOption {
+	return func(m *Metrics) { m.Offset = offset }
+}
+
+// WithStacked makes the metric stacked.
+func WithStacked() MetricOption {
+	return func(m *Metrics) { m.Stacked = true }
+}
+
+// WithAbsoluteName sets AbsoluteName of the metric.
+func WithAbsoluteName() MetricOption {
+	return func(m *Metrics) { m.AbsoluteName = true }
+}
+
+// WithThresholds sets Warning and Critical of the metric.
+func WithThresholds(warning, critical string) MetricOption {
+	return func(m *Metrics) {
+		m.Warning = warning
+		m.Critical = critical
+	}
+}
+
+// WithAggregates sets Aggregates of the metric.
+func WithAggregates(aggregates ...Aggregate) MetricOption {
+	return func(m *Metrics) { m.Aggregates = append(m.Aggregates, aggregates...) }
+}
+
+// GraphBuilder builds Graphs fluently.
+//
+//	NewGraph("memcached.cmd").Label("Memcached Command").Unit(UnitInteger).
+//		Counter("cmd_get", Uint64, WithLabel("Get")).
+//		Counter("cmd_set", Uint64, WithLabel("Set"))
+type GraphBuilder struct {
+	key   string
+	graph Graphs
+}
+
+// NewGraph returns GraphBuilder for the graph of key.
+func NewGraph(key string) *GraphBuilder {
+	return &GraphBuilder{key: key}
+}
+
+// Label sets Label of the graph.
+func (b *GraphBuilder) Label(label string) *GraphBuilder {
+	b.graph.Label = label
+	return b
+}
+
+// Unit sets Unit of the graph.
+func (b *GraphBuilder) Unit(unit Unit) *GraphBuilder {
+	b.graph.Unit = unit
+	return b
+}
+
+// Gauge adds the metric whose value is output as is.
+func (b *GraphBuilder) Gauge(name string, typ MetricType, opts ...MetricOption) *GraphBuilder {
+	return b.metric(Metrics{Name: name, Type: typ}, opts)
+}
+
+// Counter adds the metric whose differential is output.
+func (b *GraphBuilder) Counter(name string, typ MetricType, opts ...MetricOption) *GraphBuilder {
+	return b.metric(Metrics{Name: name, Type: typ, Diff: true}, opts)
+}
+
+// Derived adds the metric whose value is computed by expr.
+func (b *GraphBuilder) Derived(name string, expr string, opts ...MetricOption) *GraphBuilder {
+	return b.metric(Metrics{Name: name, Expr: expr}, opts)
+}
+
+func (b *GraphBuilder) metric(m Metrics, opts []MetricOption) *GraphBuilder {
+	for _, opt := range opts {
+		opt(&m)
+	}
+	b.graph.Metrics = append(b.graph.Metrics, m)
+	return b
+}
+
+// Aggregates sets Aggregates of the graph.
+func (b *GraphBuilder) Aggregates(aggregates ...Aggregate) *GraphBuilder {
+	b.graph.Aggregates = append(b.graph.Aggregates, aggregates...)
+	return b
+}
+
+// Filter sets Include and Exclude of the graph.
+func (b *GraphBuilder) Filter(include, exclude []string) *GraphBuilder {
+	b.graph.Include = include
+	b.graph.Exclude = exclude
+	return b
+}
+
+// MaxSeries sets MaxSeries and SeriesOrder of the graph.
+func (b *GraphBuilder) MaxSeries(n int, order string) *GraphBuilder {
+	b.graph.MaxSeries = n
+	b.graph.SeriesOrder = order
+	return b
+}
+
+// Build validates the graph, and returns its key and Graphs.
+func (b *GraphBuilder) Build() (string, Graphs, error) {
+	if err := validateGraph(b.key, b.graph); err != nil {
+		return "", Graphs{}, err
+	}
+	return b.key, b.graph, nil
+}
+
+var graphKeyReg = regexp.MustCompile(`\A[-a-zA-Z0-9_*#]+(\.[-a-zA-Z0-9_*#]+)*\z`)
+
+// validateGraph reports errors in the definition of the graph of key.
+func validateGraph(key string, graph Graphs) error {
+	var errs []error
+	if key != "" && !graphKeyReg.MatchString(key) {
+		errs = append(errs, fmt.Errorf("invalid graph key: %q", key))
+	}
+	if !graph.Unit.valid() {
+		errs = append(errs, fmt.Errorf("%s: unknown unit: %q", key, graph.Unit))
+	}
+	if len(graph.Metrics) == 0 {
+		errs = append(errs, fmt.Errorf("%s: no metrics", key))
+	}
+	names := make(map[string]bool)
+	for _, m := range graph.Metrics {
+		if m.Name == "" || !graphKeyReg.MatchString(m.Name) {
+			errs = append(errs, fmt.Errorf("%s: invalid metric name: %q", key, m.Name))
+		}
+		if names[m.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate metric name: %q", key, m.Name))
+		}
+		names[m.Name] = true
+		if !m.Type.valid() {
+			errs = append(errs, fmt.Errorf("%s.%s: unknown type: %q", key, m.Name, m.Type))
+		}
+		if !m.ValueFormat.valid() {
+			errs = append(errs, fmt.Errorf("%s.%s: unknown value format: %q", key, m.Name, m.ValueFormat))
+		}
+		if m.Expr != "" {
+			if _, err := parseExpr(m.Expr); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s: %w", key, m.Name, err))
+			}
+		}
+		for _, r := range []string{m.Warning, m.Critical} {
+			if r == "" {
+				continue
+			}
+			if _, err := parseCheckRange(r); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s: %w", key, m.Name, err))
+			}
+		}
+	}
+	for _, p := range append(append([]string{}, graph.Include...), graph.Exclude...) {
+		if _, err := regexp.Compile(p); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewGraphDefinition builds graphs, and returns them in the form of the result of Plugin.GraphDefinition.
+func NewGraphDefinition(graphs ...*GraphBuilder) (map[string]Graphs, error) {
+	defs := make(map[string]Graphs, len(graphs))
+	var errs []error
+	for _, b := range graphs {
+		key, graph, err := b.Build()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := defs[key]; ok {
+			errs = append(errs, fmt.Errorf("duplicate graph key: %q", key))
+			continue
+		}
+		defs[key] = graph
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// MustGraphDefinition is like NewGraphDefinition but panics if the graphs are invalid.
+// It is useful to initialize a package-level variable.
+func MustGraphDefinition(graphs ...*GraphBuilder) map[string]Graphs {
+	defs, err := NewGraphDefinition(graphs...)
+	if err != nil {
+		panic(err)
+	}
+	return defs
+}
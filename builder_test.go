@@ -0,0 +1,88 @@
+package mackerelplugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraphBuilder(t *testing.T) {
+	defs, err := NewGraphDefinition(
+		NewGraph("memcached.cmd").Label("Memcached Command").Unit(UnitInteger).
+			Counter("cmd_get", Uint64, WithLabel("Get")).
+			Counter("cmd_set", Uint64, WithLabel("Set"), WithStacked()),
+		NewGraph("memcached.hit_rate").Unit(UnitPercentage).
+			Derived("get", "get_hits / (get_hits + get_misses) * 100", WithThresholds("10:", "1:")),
+		NewGraph("disk.#").Unit(UnitIOPS).
+			Gauge("reads", Float64, WithScale(0.5)).
+			Aggregates(Aggregate{Func: AggregateSum}).
+			MaxSeries(10, SeriesOrderValue),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Graphs{
+		"memcached.cmd": {
+			Label: "Memcached Command",
+			Unit:  "integer",
+			Metrics: []Metrics{
+				{Name: "cmd_get", Label: "Get", Diff: true, Type: "uint64"},
+				{Name: "cmd_set", Label: "Set", Diff: true, Type: "uint64", Stacked: true},
+			},
+		},
+		"memcached.hit_rate": {
+			Unit: "percentage",
+			Metrics: []Metrics{
+				{Name: "get", Expr: "get_hits / (get_hits + get_misses) * 100", Warning: "10:", Critical: "1:"},
+			},
+		},
+		"disk.#": {
+			Unit: "iops",
+			Metrics: []Metrics{
+				{Name: "reads", Type: "float64", Scale: 0.5},
+			},
+			Aggregates:  []Aggregate{{Func: AggregateSum}},
+			MaxSeries:   10,
+			SeriesOrder: SeriesOrderValue,
+		},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("NewGraphDefinition() = %+v; want %+v", defs, want)
+	}
+}
+
+func TestGraphBuilderValidation(t *testing.T) {
+	tests := []struct {
+		b   *GraphBuilder
+		err string
+	}{
+		{NewGraph("foo").Unit("integr").Gauge("a", Float64), `unknown unit: "integr"`},
+		{NewGraph("foo").Gauge("a", "uint46"), `unknown type: "uint46"`},
+		{NewGraph("foo"), "no metrics"},
+		{NewGraph("foo bar").Gauge("a", Float64), "invalid graph key"},
+		{NewGraph("foo").Gauge("a", Float64).Gauge("a", Uint64), "duplicate metric name"},
+		{NewGraph("foo").Derived("a", "b +"), "unexpected end of expression"},
+		{NewGraph("foo").Gauge("a", Float64, WithThresholds("x", "")), "invalid range"},
+		{NewGraph("foo.#").Gauge("a", Float64).Filter([]string{"("}, nil), "missing closing )"},
+	}
+	for _, tt := range tests {
+		_, _, err := tt.b.Build()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Build(%s) = %v; want an error containing %q", tt.b.key, err, tt.err)
+		}
+	}
+
+	_, err := NewGraphDefinition(NewGraph("foo").Gauge("a", Float64), NewGraph("foo").Gauge("b", Float64))
+	if err == nil || !strings.Contains(err.Error(), "duplicate graph key") {
+		t.Errorf("NewGraphDefinition() = %v; want an error of the duplicate key", err)
+	}
+}
+
+func TestMustGraphDefinition(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("MustGraphDefinition should panic")
+		}
+	}()
+	MustGraphDefinition(NewGraph("foo"))
+}
@@ -0,0 +1,274 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckStatus represents the status of a check plugin, which is used as the exit code.
+type CheckStatus int
+
+// Statuses of check plugins
+const (
+	CheckOK       CheckStatus = 0
+	CheckWarning  CheckStatus = 1
+	CheckCritical CheckStatus = 2
+	CheckUnknown  CheckStatus = 3
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckOK:
+		return "OK"
+	case CheckWarning:
+		return "WARNING"
+	case CheckCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Threshold represents the ranges of the values of metrics in the check mode.
+//
+// Warning and Critical are written in the range format of Nagios plugins.
+// For example, "10" alerts if a value is less than 0 or greater than 10, "10:" alerts if less than 10,
+// "~:10" alerts if greater than 10, "10:20" alerts if outside of 10 to 20, and "@10:20" alerts if inside of 10 to 20.
+type Threshold struct {
+	// Key is the key of the metric, which is output by OutputValues. It can contain the wildcards.
+	Key      string
+	Warning  string
+	Critical string
+}
+
+// ParseThreshold parses s in the form of "key=warning" or "key=warning,critical".
+// It is useful to specify thresholds with command-line options.
+func ParseThreshold(s string) (Threshold, error) {
+	key, ranges, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return Threshold{}, fmt.Errorf("invalid threshold: %q", s)
+	}
+	warning, critical, _ := strings.Cut(ranges, ",")
+	t := Threshold{Key: key, Warning: warning, Critical: critical}
+	for _, r := range []string{warning, critical} {
+		if r == "" {
+			continue
+		}
+		if _, err := parseCheckRange(r); err != nil {
+			return Threshold{}, err
+		}
+	}
+	return t, nil
+}
+
+// checkRange is a range of values to alert.
+type checkRange struct {
+	start, end float64
+	inside     bool // alerts if a value is inside of the range
+}
+
+func parseCheckRange(s string) (checkRange, error) {
+	r := checkRange{start: 0, end: math.Inf(1)}
+	str := s
+	if strings.HasPrefix(str, "@") {
+		r.inside = true
+		str = str[1:]
+	}
+	if str == "" {
+		return r, fmt.Errorf("invalid range: %q", s)
+	}
+	start, end, ok := strings.Cut(str, ":")
+	if !ok {
+		start, end = "", str
+	}
+	var err error
+	switch start {
+	case "":
+	case "~":
+		r.start = math.Inf(-1)
+	default:
+		if r.start, err = strconv.ParseFloat(start, 64); err != nil {
+			return r, fmt.Errorf("invalid range: %q", s)
+		}
+	}
+	if end != "" {
+		if r.end, err = strconv.ParseFloat(end, 64); err != nil {
+			return r, fmt.Errorf("invalid range: %q", s)
+		}
+	}
+	if r.start > r.end {
+		return r, fmt.Errorf("invalid range: %q", s)
+	}
+	return r, nil
+}
+
+func (r checkRange) alert(v float64) bool {
+	inside := r.start <= v && v <= r.end
+	return inside == r.inside
+}
+
+// Scopes of thresholds, which decide whether they are applied to the aggregated series
+const (
+	thresholdAny       = iota // given by Thresholds, which is applied to any series matching Key
+	thresholdSeries           // given by Metrics, which is not applied to the aggregated series
+	thresholdAggregate        // given by Aggregate, which is applied only to the aggregated series
+)
+
+type scopedThreshold struct {
+	Threshold
+	scope int
+}
+
+// thresholds returns the thresholds of the metrics and the aggregates in h.GraphDefinition() and h.Thresholds.
+func (h *MackerelPlugin) thresholds() []scopedThreshold {
+	var thresholds []scopedThreshold
+	add := func(key, warning, critical string, scope int) {
+		if warning == "" && critical == "" {
+			return
+		}
+		thresholds = append(thresholds, scopedThreshold{Threshold{Key: key, Warning: warning, Critical: critical}, scope})
+	}
+	for key, graph := range h.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			add(h.metricKey(key, metric.Name), metric.Warning, metric.Critical, thresholdSeries)
+			if !strings.Contains(key, "#") && !strings.ContainsAny(metric.Name, "*#") {
+				continue
+			}
+			for _, a := range append(append([]Aggregate{}, graph.Aggregates...), metric.Aggregates...) {
+				add(h.metricKey("", aggregateKey(key, metric, a)), a.Warning, a.Critical, thresholdAggregate)
+			}
+		}
+	}
+	for _, t := range h.Thresholds {
+		thresholds = append(thresholds, scopedThreshold{t, thresholdAny})
+	}
+	return thresholds
+}
+
+type checkResult struct {
+	status CheckStatus
+	key    string
+	value  float64
+	rng    string
+}
+
+// checkTempfileSuffix is appended to Tempfile in the check mode,
+// so that the differentials in the check mode and in the metric mode are computed separately.
+const checkTempfileSuffix = ".check"
+
+// Check fetches the metrics, computes the values as OutputValues does, and checks them with the thresholds.
+// It returns the status and the message of the check.
+// The last values are saved to Tempfile with the suffix ".check", or to StateStore if it is set.
+func (h *MackerelPlugin) Check() (CheckStatus, string) {
+	type compiledThreshold struct {
+		scopedThreshold
+		key               *regexp.Regexp
+		warning, critical *checkRange
+	}
+	var thresholds []compiledThreshold
+	for _, t := range h.thresholds() {
+		c := compiledThreshold{scopedThreshold: t, key: thresholdKeyRegexp(t.Key)}
+		if t.Warning != "" {
+			r, err := parseCheckRange(t.Warning)
+			if err != nil {
+				return CheckUnknown, fmt.Sprintf("%s: %v", t.Key, err)
+			}
+			c.warning = &r
+		}
+		if t.Critical != "" {
+			r, err := parseCheckRange(t.Critical)
+			if err != nil {
+				return CheckUnknown, fmt.Sprintf("%s: %v", t.Key, err)
+			}
+			c.critical = &r
+		}
+		thresholds = append(thresholds, c)
+	}
+	if len(thresholds) == 0 {
+		return CheckUnknown, "no thresholds are specified"
+	}
+
+	tempfile := h.tempfilename()
+	h.Tempfile = tempfile + checkTempfileSuffix
+	defer func() { h.Tempfile = tempfile }()
+	h.aggregated = make(map[string]bool)
+	defer func() { h.aggregated = nil }()
+
+	checked := 0
+	var results []checkResult
+	err := h.collectValues(func(key string, value interface{}, now time.Time) {
+		v := toFloat64(value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return
+		}
+		for _, t := range thresholds {
+			if !t.key.MatchString(key) {
+				continue
+			}
+			switch t.scope {
+			case thresholdSeries:
+				if h.aggregated[key] {
+					continue
+				}
+			case thresholdAggregate:
+				if !h.aggregated[key] {
+					continue
+				}
+			}
+			checked++
+			switch {
+			case t.critical != nil && t.critical.alert(v):
+				results = append(results, checkResult{CheckCritical, key, v, t.Critical})
+			case t.warning != nil && t.warning.alert(v):
+				results = append(results, checkResult{CheckWarning, key, v, t.Warning})
+			}
+		}
+	})
+	if err != nil {
+		return CheckUnknown, err.Error()
+	}
+	if checked == 0 {
+		return CheckUnknown, "no values matched the thresholds"
+	}
+	if len(results) == 0 {
+		return CheckOK, fmt.Sprintf("%d values are within the thresholds", checked)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].status != results[j].status {
+			return results[i].status > results[j].status
+		}
+		return results[i].key < results[j].key
+	})
+	msgs := make([]string, 0, len(results))
+	for _, r := range results {
+		msgs = append(msgs, fmt.Sprintf("%s=%s (%s: %s)", r.key, strconv.FormatFloat(r.value, 'f', -1, 64), strings.ToLower(r.status.String()), r.rng))
+	}
+	return results[0].status, strings.Join(msgs, ", ")
+}
+
+// RunCheck runs the plugin as a check plugin, and exits with the status.
+func (h *MackerelPlugin) RunCheck() {
+	status, msg := h.Check()
+	fmt.Printf("%s: %s\n", status, msg)
+	os.Exit(int(status))
+}
+
+// thresholdKeyRegexp returns the regular expression to match keys with key, which may contain the wildcards.
+func thresholdKeyRegexp(key string) *regexp.Regexp {
+	segments := strings.Split(key, ".")
+	for i, s := range segments {
+		if s == "*" || s == "#" {
+			segments[i] = "[-a-zA-Z0-9_]+"
+		} else {
+			segments[i] = regexp.QuoteMeta(s)
+		}
+	}
+	return regexp.MustCompile(`\A` + strings.Join(segments, `\.`) + `\z`)
+}
@@ -0,0 +1,153 @@
+package mackerelplugin
+
+import (
+	"testing"
+
+	"github.com/mackerelio/go-mackerel-plugin-helper/internal/memstate"
+)
+
+func TestParseCheckRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		alerts []float64
+		oks    []float64
+	}{
+		{"10", []float64{-1, 10.5}, []float64{0, 5, 10}},
+		{"10:", []float64{-1, 9.9}, []float64{10, 1e10}},
+		{"~:10", []float64{10.1}, []float64{-1e10, 10}},
+		{"10:20", []float64{9, 21}, []float64{10, 15, 20}},
+		{"@10:20", []float64{10, 15, 20}, []float64{9, 21}},
+	}
+	for _, tt := range tests {
+		r, err := parseCheckRange(tt.s)
+		if err != nil {
+			t.Errorf("parseCheckRange(%q): %v", tt.s, err)
+			continue
+		}
+		for _, v := range tt.alerts {
+			if !r.alert(v) {
+				t.Errorf("%q should alert %v", tt.s, v)
+			}
+		}
+		for _, v := range tt.oks {
+			if r.alert(v) {
+				t.Errorf("%q should not alert %v", tt.s, v)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "a", "20:10", "1:b", "@"} {
+		if _, err := parseCheckRange(s); err == nil {
+			t.Errorf("parseCheckRange(%q) should return an error", s)
+		}
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	th, err := ParseThreshold("memcached.evictions=~:100,~:200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Threshold{Key: "memcached.evictions", Warning: "~:100", Critical: "~:200"}
+	if th != want {
+		t.Errorf("ParseThreshold() = %v; want %v", th, want)
+	}
+
+	for _, s := range []string{"memcached.evictions", "=10", "foo=x"} {
+		if _, err := ParseThreshold(s); err == nil {
+			t.Errorf("ParseThreshold(%q) should return an error", s)
+		}
+	}
+}
+
+type testCheckP struct{}
+
+func (t testCheckP) FetchMetrics() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"evictions":   120.0,
+		"conns":       5.0,
+		"disk.sda.ut": 50.0,
+		"disk.sdb.ut": 95.0,
+	}, nil
+}
+
+func (t testCheckP) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"": {
+			Metrics: []Metrics{
+				{Name: "evictions", Warning: "~:100", Critical: "~:1000"},
+				{Name: "conns"},
+			},
+		},
+		"disk.#": {
+			Metrics: []Metrics{
+				{Name: "ut", Warning: "~:80", Critical: "~:90"},
+			},
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := NewMackerelPlugin(testCheckP{})
+	status, msg := p.Check()
+	if status != CheckCritical {
+		t.Errorf("status = %v; want %v", status, CheckCritical)
+	}
+	want := "disk.sdb.ut=95 (critical: ~:90), evictions=120 (warning: ~:100)"
+	if msg != want {
+		t.Errorf("message = %q; want %q", msg, want)
+	}
+
+	p.Thresholds = []Threshold{{Key: "conns", Critical: "1:"}}
+	p.Plugin = testCheckP{}
+	status, _ = p.Check()
+	if status != CheckCritical {
+		t.Errorf("status = %v; want %v", status, CheckCritical)
+	}
+}
+
+func TestCheckOK(t *testing.T) {
+	p := NewMackerelPlugin(testP{})
+	p.Thresholds = []Threshold{{Key: "testP.#.baz", Warning: "20"}}
+	status, msg := p.Check()
+	if status != CheckOK {
+		t.Errorf("status = %v; want %v: %s", status, CheckOK, msg)
+	}
+
+	p.Thresholds = []Threshold{{Key: "testP.unknown", Warning: "20"}}
+	status, _ = p.Check()
+	if status != CheckUnknown {
+		t.Errorf("status = %v; want %v", status, CheckUnknown)
+	}
+}
+
+type testCheckAggregateP struct {
+	aggregates []Aggregate
+}
+
+func (t testCheckAggregateP) FetchMetrics() (map[string]interface{}, error) {
+	return map[string]interface{}{"disk.sda.r": 80.0, "disk.sdb.r": 100.0}, nil
+}
+
+func (t testCheckAggregateP) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"disk.#": {
+			Metrics:    []Metrics{{Name: "r", Warning: "~:100"}},
+			Aggregates: t.aggregates,
+		},
+	}
+}
+
+func TestCheckAggregates(t *testing.T) {
+	p := NewMackerelPlugin(testCheckAggregateP{aggregates: []Aggregate{{Func: AggregateSum}}})
+	p.StateStore = &memstate.State{}
+	if status, msg := p.Check(); status != CheckOK {
+		t.Errorf("the threshold of the metric is applied to the aggregated series: %v, %q", status, msg)
+	}
+
+	p.Plugin = testCheckAggregateP{aggregates: []Aggregate{{Func: AggregateSum, Warning: "~:150"}, {Func: AggregateMax, Critical: "~:90"}}}
+	status, msg := p.Check()
+	if want := "disk.max.r=100 (critical: ~:90), disk.sum.r=180 (warning: ~:150)"; status != CheckCritical || msg != want {
+		t.Errorf("Check() = %v, %q; want %v, %q", status, msg, CheckCritical, want)
+	}
+}
@@ -0,0 +1,47 @@
+// Command mackerel-plugin-exec runs a command which prints metrics, and outputs them as a plugin of mackerel-agent.
+// The differentials and the scales are computed with the graph definitions in a file.
+//
+//	mackerel-plugin-exec -graphs graphs.json [options] -- command [args...]
+//
+// The command prints lines of a key and a value separated by tabs or spaces, or a JSON object.
+// See ParseGraphDefinition of github.com/mackerelio/go-mackerel-plugin-helper for the format of the graph definitions.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+func main() {
+	optGraphs := flag.String("graphs", "", "File of graph definitions (required)")
+	optOutputFormat := flag.String("output-format", mp.ExecFormatAuto, "Format of the output of the command, text or json (default: auto)")
+	opts := mp.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -graphs FILE [options] -- command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *optGraphs == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	graphs, err := mp.LoadGraphDefinition(*optGraphs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	plugin := &mp.ExecPlugin{
+		Command: flag.Args(),
+		Format:  *optOutputFormat,
+		Graphs:  graphs,
+		Timeout: opts.Timeout,
+	}
+	helper := mp.NewMackerelPlugin(plugin)
+	opts.Apply(&helper)
+
+	helper.Run()
+}
@@ -0,0 +1,289 @@
+package mackerelplugin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/go-mackerel-plugin-helper/plugintest"
+)
+
+// statPlugin returns *stat from FetchMetrics, so that a test changes the values between the cycles.
+type statPlugin struct {
+	stat   *map[string]interface{}
+	graphs map[string]mp.Graphs
+}
+
+func (p statPlugin) FetchMetrics() (map[string]interface{}, error) {
+	return *p.stat, nil
+}
+
+func (p statPlugin) GraphDefinition() map[string]mp.Graphs {
+	return p.graphs
+}
+
+func TestDerivedValuesOfDerivedValues(t *testing.T) {
+	stat := map[string]interface{}{"hits": 30.0, "misses": 10.0}
+	r := plugintest.New(statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"cache": {
+			Metrics: []mp.Metrics{
+				// hr2 is defined before hr, which it refers to.
+				{Name: "hr2", Expr: "hr * 2"},
+				{Name: "hr", Expr: "hits / (hits + misses)"},
+				{Name: "hits"},
+				{Name: "misses"},
+				{Name: "loop_a", Expr: "loop_b + 1"},
+				{Name: "loop_b", Expr: "loop_a + 1"},
+			},
+		},
+	}})
+	c := r.Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	for key, want := range map[string]float64{"cache.hr": 0.75, "cache.hr2": 1.5} {
+		if m, ok := c.Lookup(key); !ok || m.Value != want {
+			t.Errorf("%s = %v; want %v", key, m.Value, want)
+		}
+	}
+	for _, key := range []string{"cache.loop_a", "cache.loop_b"} {
+		if m, ok := c.Lookup(key); ok {
+			t.Errorf("%s = %v; want no value for the circular reference", key, m.Value)
+		}
+	}
+
+	// A derived metric which is not output makes the derived metrics referring to it not output either.
+	stat = map[string]interface{}{"hits": 0.0, "misses": 0.0}
+	c = r.Run()
+	if m, ok := c.Lookup("cache.hr2"); ok {
+		t.Errorf("cache.hr2 = %v; want no value when cache.hr is not output", m.Value)
+	}
+}
+
+// slowPlugin advances clock in FetchMetrics as if fetching the metrics took a while.
+type slowPlugin struct {
+	statPlugin
+	clock *plugintest.Clock
+}
+
+func (p slowPlugin) FetchMetrics() (map[string]interface{}, error) {
+	p.clock.Advance(time.Second)
+	return p.statPlugin.FetchMetrics()
+}
+
+func TestRecordPluginRecordsTimestamp(t *testing.T) {
+	stat := map[string]interface{}{"cmd_get": 1.0}
+	p := &slowPlugin{statPlugin: statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"cmd": {Metrics: []mp.Metrics{{Name: "cmd_get"}}},
+	}}}
+	var buf bytes.Buffer
+	h := mp.NewMackerelPlugin(mp.RecordPlugin(p, &buf))
+	r := plugintest.NewWithHelper(&h)
+	p.clock = r.Clock
+	c := r.Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+
+	var rec struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := c.Lookup("cmd.cmd_get")
+	if !ok {
+		t.Fatal("cmd.cmd_get is not output")
+	}
+	if !rec.Time.Equal(m.Time) {
+		t.Errorf("recorded time = %v; want %v of the output", rec.Time, m.Time)
+	}
+}
+
+func TestDerivedValuesOfDiffCounters(t *testing.T) {
+	stat := map[string]interface{}{"cmd_get": "1000", "cmd_set": "200", "curr_connections": "10"}
+	r := plugintest.New(statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"cmd": {
+			Metrics: []mp.Metrics{
+				{Name: "cmd_get", Diff: true, Type: mp.Uint64},
+				{Name: "cmd_set", Diff: true, Type: mp.Uint64},
+				{Name: "total", Expr: "cmd_get + cmd_set"},
+				{Name: "per_conn", Expr: "cmd_get / curr_connections"},
+			},
+		},
+	}})
+
+	// The counters are not diffed at the first run, so the derived metrics must not use the raw values.
+	c := r.Run()
+	for _, key := range []string{"cmd.total", "cmd.per_conn"} {
+		if m, ok := c.Lookup(key); ok {
+			t.Errorf("%s = %v at the first run; want no value", key, m.Value)
+		}
+	}
+
+	stat = map[string]interface{}{"cmd_get": "1120", "cmd_set": "230", "curr_connections": "10"}
+	c = r.Run()
+	if m, _ := c.Lookup("cmd.total"); m.Value != 150.0 {
+		t.Errorf("cmd.total = %v; want 150", m.Value)
+	}
+	// curr_connections is not defined, so its fetched value is used.
+	if m, _ := c.Lookup("cmd.per_conn"); m.Value != 12.0 {
+		t.Errorf("cmd.per_conn = %v; want 12", m.Value)
+	}
+
+	// The counters are not diffed after a long gap either.
+	r.Clock.Advance(time.Hour)
+	c = r.Run()
+	if m, ok := c.Lookup("cmd.total"); ok {
+		t.Errorf("cmd.total = %v after a gap; want no value", m.Value)
+	}
+}
+
+func TestValueFormatWithScaleAndDiff(t *testing.T) {
+	stat := map[string]interface{}{"used": "1M", "traffic": "1G", "latency": "250ms"}
+	r := plugintest.New(statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"mem": {
+			Metrics: []mp.Metrics{
+				{Name: "used", ValueFormat: mp.ValueFormatBytes, Type: mp.Uint64, Scale: 2},
+				{Name: "traffic", ValueFormat: mp.ValueFormatBytes, Type: mp.Uint64, Diff: true},
+				{Name: "latency", ValueFormat: mp.ValueFormatDuration, Scale: 1000},
+			},
+		},
+	}})
+
+	c := r.Run()
+	if m, _ := c.Lookup("mem.used"); m.Value != uint64(2*1024*1024) {
+		t.Errorf("mem.used = %#v; want %d", m.Value, 2*1024*1024)
+	}
+	if m, _ := c.Lookup("mem.latency"); m.Value != 250.0 {
+		t.Errorf("mem.latency = %#v; want 250", m.Value)
+	}
+
+	stat["traffic"] = "1.5G"
+	c = r.Run()
+	if m, _ := c.Lookup("mem.traffic"); m.Value != float64(512*1024*1024) {
+		t.Errorf("mem.traffic = %#v; want %d", m.Value, 512*1024*1024)
+	}
+}
+
+func TestExecPluginWithHelper(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	p := &mp.ExecPlugin{
+		Command: []string{"sh", "-c", `echo 'requests 1,200'`},
+		Graphs: map[string]mp.Graphs{
+			"app": {Metrics: []mp.Metrics{{Name: "requests", Diff: true, Type: mp.Uint64}}},
+		},
+	}
+	r := plugintest.New(p)
+	if c := r.Run(); c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	p.Command = []string{"sh", "-c", `echo 'requests 1,320'`}
+	c := r.Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	if m, _ := c.Lookup("app.requests"); m.Value != 120.0 {
+		t.Errorf("app.requests = %v; want 120", m.Value)
+	}
+}
+
+func TestPrometheusPluginWithHelper(t *testing.T) {
+	requests := 1000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE http_requests_total counter\n")
+		fmt.Fprintf(w, "http_requests_total{method=\"GET\",code=\"200\"} %d\n", requests)
+		fmt.Fprintf(w, "go_goroutines 42\n")
+	}))
+	defer srv.Close()
+
+	r := plugintest.New(&mp.PrometheusPlugin{URL: srv.URL, Prefix: "prom", Timeout: time.Second})
+	if c := r.Run(); c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	requests += 120
+	c := r.Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	if m, _ := c.Lookup("prom.http_requests_total.200.GET"); m.Value != 120.0 {
+		t.Errorf("http_requests_total = %v; want 120", m.Value)
+	}
+	if m, _ := c.Lookup("prom.go_goroutines"); m.Value != 42.0 {
+		t.Errorf("go_goroutines = %v; want 42", m.Value)
+	}
+	if _, ok := r.Definitions()["prom"]; !ok {
+		t.Errorf("graph prom of the metrics without labels is not defined: %v", r.Definitions())
+	}
+}
+
+func TestCheckUsesSeparateTempfile(t *testing.T) {
+	stat := map[string]interface{}{"evictions": 1000.0}
+	h := mp.NewMackerelPlugin(statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"": {Metrics: []mp.Metrics{{Name: "evictions", Diff: true, Warning: "~:100"}}},
+	}})
+	h.Tempfile = filepath.Join(t.TempDir(), "state")
+	clock := plugintest.NewClock(plugintest.DefaultStart)
+	h.Clock = clock
+
+	if status, _ := h.Check(); status != mp.CheckUnknown {
+		t.Errorf("status at the first run = %v; want %v", status, mp.CheckUnknown)
+	}
+	if _, err := os.Stat(h.Tempfile); !os.IsNotExist(err) {
+		t.Errorf("Check should not write %s: %v", h.Tempfile, err)
+	}
+	if _, err := os.Stat(h.Tempfile + ".check"); err != nil {
+		t.Errorf("Check should write %s.check: %v", h.Tempfile, err)
+	}
+
+	// The metric mode does not affect the differential in the check mode.
+	clock.Advance(30 * time.Second)
+	stat["evictions"] = 1100.0
+	if err := h.CollectValues(func(string, interface{}, time.Time) {}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	stat["evictions"] = 1200.0
+	status, msg := h.Check()
+	if want := "evictions=200 (warning: ~:100)"; status != mp.CheckWarning || msg != want {
+		t.Errorf("Check() = %v, %q; want %v, %q", status, msg, mp.CheckWarning, want)
+	}
+}
+
+// sleepPlugin sleeps in FetchMetrics for d of the system clock.
+type sleepPlugin struct {
+	statPlugin
+	d time.Duration
+}
+
+func (p sleepPlugin) FetchMetrics() (map[string]interface{}, error) {
+	time.Sleep(p.d)
+	return p.statPlugin.FetchMetrics()
+}
+
+func TestSelfMetricsFetchDurationWithClock(t *testing.T) {
+	stat := map[string]interface{}{"requests": 1.0}
+	h := mp.NewMackerelPlugin(sleepPlugin{d: 10 * time.Millisecond, statPlugin: statPlugin{stat: &stat, graphs: map[string]mp.Graphs{
+		"app": {Metrics: []mp.Metrics{{Name: "requests"}}},
+	}}})
+	h.MetricKeyPrefix = "self"
+	h.SelfMetrics = true
+	c := plugintest.NewWithHelper(&h).Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	// Clock of the runner does not advance during the fetch, so the duration is measured by the system clock.
+	if m, ok := c.Lookup("self.plugin_helper.self.fetch.duration"); !ok || m.Float64() < 0.01 {
+		t.Errorf("plugin_helper.self.fetch.duration = %v; want at least 0.01", m.Value)
+	}
+}
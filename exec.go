@@ -0,0 +1,180 @@
+package mackerelplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the output of commands run by ExecPlugin
+const (
+	// ExecFormatAuto detects the format: JSON if the output begins with "{", otherwise text. It is the default.
+	ExecFormatAuto = ""
+	// ExecFormatText is lines of a key and a value separated by tabs or spaces.
+	// Empty lines and lines beginning with "#" are ignored, and fields after the value, such as a timestamp, are ignored.
+	ExecFormatText = "text"
+	// ExecFormatJSON is a JSON object, whose nested keys are joined by "." as FlattenJSON does.
+	ExecFormatJSON = "json"
+)
+
+// ExecPlugin is Plugin which runs a command and parses its output as the fetched values.
+// With graph definitions from a file, it makes a script output differentials with the state kept by the helper.
+type ExecPlugin struct {
+	// Command is the name of the command and its arguments.
+	Command []string
+	// Format is the format of the output, ExecFormatAuto, ExecFormatText or ExecFormatJSON.
+	Format string
+	// Graphs are the graph definitions, which can be loaded by LoadGraphDefinition.
+	Graphs map[string]Graphs
+	// Timeout limits the time of the command. Zero means no limit.
+	Timeout time.Duration
+}
+
+// FetchMetrics runs the command and parses its output.
+// If the command fails or some lines cannot be parsed, the parsed values are returned with PartialError.
+func (p *ExecPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if len(p.Command) == 0 {
+		return nil, errors.New("no command is specified")
+	}
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stderr = &stderr
+	// Child processes of the command may keep the output open after the command is killed on timeout.
+	cmd.WaitDelay = time.Second
+	out, runErr := cmd.Output()
+	if runErr != nil {
+		runErr = fmt.Errorf("%s: %w", p.Command[0], runErr)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			runErr = fmt.Errorf("%w: %s", runErr, msg)
+		}
+	}
+
+	stat, err := parseExecOutput(out, p.Format)
+	if len(stat) == 0 {
+		return nil, errors.Join(runErr, err)
+	}
+	return stat, NewPartialError(runErr, err)
+}
+
+// GraphDefinition returns p.Graphs.
+func (p *ExecPlugin) GraphDefinition() map[string]Graphs {
+	return p.Graphs
+}
+
+func parseExecOutput(out []byte, format string) (map[string]interface{}, error) {
+	if format == ExecFormatAuto {
+		format = ExecFormatText
+		if bytes.HasPrefix(bytes.TrimSpace(out), []byte("{")) {
+			format = ExecFormatJSON
+		}
+	}
+	switch format {
+	case ExecFormatText:
+		return parseTextValues(bytes.NewReader(out))
+	case ExecFormatJSON:
+		stat, err := FlattenJSON(bytes.NewReader(out))
+		if err != nil {
+			return nil, err
+		}
+		return stat, nil
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
+
+// parseTextValues parses lines of a key and a value separated by tabs or spaces.
+// It returns the parsed values with the errors of the lines which cannot be parsed.
+func parseTextValues(r io.Reader) (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+	var errs []error
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			errs = append(errs, fmt.Errorf("line %d: no value: %q", n, line))
+			continue
+		}
+		stat[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return stat, errors.Join(errs...)
+}
+
+// FlattenJSON decodes a JSON object from r, and flattens it into the values whose keys are joined by ".",
+// which can be matched by the wildcards in the graph definitions.
+// The elements of an array are keyed by their indexes, such as "servers.0.requests",
+// and the characters in the keys other than letters, digits, "-" and "_" are replaced with "_".
+// Numbers are kept as strings so that they are parsed in Type of the metrics, booleans are 1 or 0, and nulls are omitted.
+func FlattenJSON(r io.Reader) (map[string]interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("not a JSON object: %T", v)
+	}
+	stat := make(map[string]interface{})
+	flattenValue(stat, "", v)
+	return stat, nil
+}
+
+// keySegment replaces the characters in s which cannot be matched by the wildcards with "_".
+func keySegment(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func flattenValue(stat map[string]interface{}, key string, v interface{}) {
+	join := func(k string) string {
+		k = keySegment(k)
+		if key == "" {
+			return k
+		}
+		return key + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			flattenValue(stat, join(k), e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenValue(stat, join(strconv.Itoa(i)), e)
+		}
+	case json.Number:
+		stat[key] = v.String()
+	case bool:
+		if v {
+			stat[key] = 1.0
+		} else {
+			stat[key] = 0.0
+		}
+	case string:
+		stat[key] = v
+	}
+}
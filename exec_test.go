@@ -0,0 +1,153 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shellCommand(t *testing.T, script string) []string {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	return []string{"sh", "-c", script}
+}
+
+func TestExecPluginText(t *testing.T) {
+	p := &ExecPlugin{Command: shellCommand(t, `printf '# comment\nrequests\t120\t1700000000\nworkers 4\n\n'`)}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"requests": "120", "workers": "4"}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics() = %v; want %v", stat, want)
+	}
+}
+
+func TestExecPluginJSON(t *testing.T) {
+	p := &ExecPlugin{Command: shellCommand(t, `echo '{"requests": 120, "pools": {"web": {"busy": 3}}}'`)}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"requests": "120", "pools.web.busy": "3"}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics() = %v; want %v", stat, want)
+	}
+}
+
+func TestExecPluginPartialFailure(t *testing.T) {
+	p := &ExecPlugin{Command: shellCommand(t, `echo 'requests 120'; echo broken; echo 'oops' >&2; exit 1`)}
+	stat, err := p.FetchMetrics()
+	var partial *PartialError
+	if !errors.As(err, &partial) || len(partial.Errors) != 2 {
+		t.Fatalf("FetchMetrics() returns %v; want PartialError of the exit status and the line", err)
+	}
+	if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error %q does not contain stderr", err)
+	}
+	if stat["requests"] != "120" {
+		t.Errorf("FetchMetrics() = %v; want requests", stat)
+	}
+}
+
+func TestExecPluginFailure(t *testing.T) {
+	p := &ExecPlugin{Command: shellCommand(t, `exit 1`)}
+	if _, err := p.FetchMetrics(); err == nil || errors.As(err, new(*PartialError)) {
+		t.Errorf("FetchMetrics() returns %v; want an error which is not PartialError", err)
+	}
+
+	p = &ExecPlugin{Command: shellCommand(t, `exec sleep 10`), Timeout: 10 * time.Millisecond}
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics() should time out")
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	in := `{
+		"uptime": 3600,
+		"counter": 18446744073709551615,
+		"ready": true,
+		"version": "1.2.3",
+		"none": null,
+		"servers": [{"name": "a", "requests": 10}, {"name": "b", "requests": 20}],
+		"paths": {"/api/v1": {"hits": 5}}
+	}`
+	got, err := FlattenJSON(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"uptime":             "3600",
+		"counter":            "18446744073709551615",
+		"ready":              1.0,
+		"version":            "1.2.3",
+		"servers.0.name":     "a",
+		"servers.0.requests": "10",
+		"servers.1.name":     "b",
+		"servers.1.requests": "20",
+		"paths._api_v1.hits": "5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FlattenJSON() = %v; want %v", got, want)
+	}
+
+	if _, err := FlattenJSON(strings.NewReader(`[1, 2]`)); err == nil {
+		t.Error("FlattenJSON should return an error for an array")
+	}
+}
+
+func TestParseGraphDefinition(t *testing.T) {
+	in := `{
+		"graphs": {
+			"app.requests": {
+				"label": "Requests",
+				"unit": "integer",
+				"metrics": [
+					{"name": "requests", "diff": true, "type": "uint64"},
+					{"name": "latency", "value_format": "duration", "scale": 1000}
+				]
+			},
+			"app.servers.#": {
+				"metrics": [{"name": "requests", "diff": true}],
+				"max_series": 10
+			}
+		}
+	}`
+	got, err := ParseGraphDefinition(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Graphs{
+		"app.requests": {
+			Label: "Requests",
+			Unit:  UnitInteger,
+			Metrics: []Metrics{
+				{Name: "requests", Diff: true, Type: Uint64},
+				{Name: "latency", ValueFormat: ValueFormatDuration, Scale: 1000},
+			},
+		},
+		"app.servers.#": {
+			Metrics:   []Metrics{{Name: "requests", Diff: true}},
+			MaxSeries: 10,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseGraphDefinition() = %#v; want %#v", got, want)
+	}
+
+	for _, in := range []string{
+		`{"graphs": {"app": {"metrics": [{"name": "a", "typo": true}]}}}`,
+		`{"graphs": {"app": {"metrics": [{"name": "a", "type": "int"}]}}}`,
+		`{"graphs": {"app": {"metrics": []}}}`,
+	} {
+		if _, err := ParseGraphDefinition(strings.NewReader(in)); err == nil {
+			t.Errorf("ParseGraphDefinition(%s) should return an error", in)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvDebug is the environment variable to enable the debug mode.
+const EnvDebug = "MACKEREL_PLUGIN_DEBUG"
+
+// explanation records how the value of a metric is computed in the debug mode.
+// All methods of nil *explanation do nothing, so that callers need not check whether the debug mode is enabled.
+type explanation struct {
+	key   string
+	steps []string
+}
+
+// explain returns a new explanation for the metric whose output key is key,
+// or nil if the debug mode is disabled.
+func (h *MackerelPlugin) explain(key string) *explanation {
+	if !h.debugEnabled() {
+		return nil
+	}
+	return &explanation{key: key}
+}
+
+func (h *MackerelPlugin) debugEnabled() bool {
+	if h.Debug {
+		return true
+	}
+	b, _ := strconv.ParseBool(os.Getenv(EnvDebug))
+	return b
+}
+
+func (e *explanation) add(format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	e.steps = append(e.steps, fmt.Sprintf(format, args...))
+}
+
+// output reports that value is output.
+func (e *explanation) output(value interface{}) {
+	if e == nil {
+		return
+	}
+	e.add("output=%v", value)
+	e.flush()
+}
+
+// drop reports that the value is not output because of reason.
+func (e *explanation) drop(reason string) {
+	if e == nil {
+		return
+	}
+	e.add("dropped: %s", reason)
+	e.flush()
+}
+
+func (e *explanation) flush() {
+	log.Printf("[debug] %s: %s\n", e.key, strings.Join(e.steps, ", "))
+	e.steps = nil
+}
@@ -0,0 +1,101 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestExplainFormatValues(t *testing.T) {
+	buf := captureLog(t)
+	mp := MackerelPlugin{Plugin: testP{}, Debug: true}
+	mp.output = func(string, interface{}, time.Time) {}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": "1000", "cmd_set": uint64(10)},
+		Timestamp: now,
+	}
+	lastMetricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": uint64(500), "cmd_set": uint64(500)},
+		Timestamp: now.Add(-60 * time.Second),
+	}
+	mp.formatValues("foo", Metrics{Name: "cmd_get", Diff: true, Type: "uint64", Scale: 2}, metricValues, lastMetricValues)
+	mp.formatValues("foo", Metrics{Name: "cmd_set", Diff: true, Type: "uint64"}, metricValues, lastMetricValues)
+	mp.formatValues("foo", Metrics{Name: "cmd_touch"}, metricValues, lastMetricValues)
+
+	want := []string{
+		`[debug] testP.foo.cmd_get: name=cmd_get, raw="1000", parsed=1000 (uint64), last=500 at 1437227180, last_diff=0, diff=500, scale=2, output=1000`,
+		`[debug] testP.foo.cmd_set: name=cmd_set, raw=10, parsed=10 (uint64), last=500 at 1437227180, last_diff=0, dropped: counter seems to be reset`,
+		`[debug] testP.foo.cmd_touch: name=cmd_touch, dropped: not fetched`,
+	}
+	var got []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(l, "[debug]") {
+			got = append(got, l)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("explanation:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExplainDisabled(t *testing.T) {
+	buf := captureLog(t)
+	var mp MackerelPlugin
+	mp.output = func(string, interface{}, time.Time) {}
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": 1.0},
+		Timestamp: time.Unix(1437227240, 0),
+	}
+	mp.formatValues("foo", Metrics{Name: "cmd_get"}, metricValues, MetricValues{})
+	if buf.Len() != 0 {
+		t.Errorf("nothing should be logged: %s", buf)
+	}
+
+	t.Setenv(EnvDebug, "1")
+	mp.formatValues("foo", Metrics{Name: "cmd_get"}, metricValues, MetricValues{})
+	if !strings.HasPrefix(buf.String(), "[debug] foo.cmd_get: ") {
+		t.Errorf("%s should enable the debug mode: %s", EnvDebug, buf)
+	}
+}
+
+func TestExplainMaxSeries(t *testing.T) {
+	buf := captureLog(t)
+	mp := MackerelPlugin{Plugin: testP{}, Debug: true}
+	mp.output = func(string, interface{}, time.Time) {}
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"disk.sda.r": 1.0, "disk.sdb.r": 2.0},
+		Timestamp: time.Unix(1437227240, 0),
+	}
+	graph := Graphs{Metrics: []Metrics{{Name: "r"}}, MaxSeries: 1}
+	mp.formatGraphWithWildcard("disk.#", graph, graph.Metrics, metricValues, MetricValues{})
+
+	want := []string{
+		`[debug] testP.disk.sda.r: name=disk.sda.r, raw=1, parsed=1 (float64), output=1`,
+		`[debug] testP.disk.sdb.r: name=disk.sdb.r, raw=2, parsed=2 (float64), dropped: exceeded MaxSeries`,
+	}
+	var got []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(l, "[debug]") {
+			got = append(got, l)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("explanation:\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,228 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a parsed arithmetic expression used by derived metrics.
+type expr interface {
+	eval(lookup func(name string) (float64, bool)) (float64, error)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(func(string) (float64, bool)) (float64, error) {
+	return float64(e), nil
+}
+
+type identExpr string
+
+func (e identExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, ok := lookup(string(e))
+	if !ok {
+		return 0, fmt.Errorf("%s does not exist", string(e))
+	}
+	return v, nil
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (e negExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	return -v, nil
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+var errDivisionByZero = errors.New("division by zero")
+
+func (e binaryExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	x, err := e.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	case '/':
+		if y == 0 {
+			return 0, errDivisionByZero
+		}
+		return x / y, nil
+	}
+	return 0, fmt.Errorf("unknown operator: %c", e.op)
+}
+
+// parseExpr parses s as an arithmetic expression.
+//
+// The grammar supports numbers, the binary operators + - * /, unary minus and parentheses.
+// Identifiers consist of letters, digits, '_' and '.', and must not begin with a digit.
+// Any other metric name can be written in braces, e.g. {foo-bar.baz}.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d in %q", p.s[p.pos], p.pos, s)
+	}
+	return e, nil
+}
+
+// exprNames returns the names which e refers to.
+func exprNames(e expr) []string {
+	switch e := e.(type) {
+	case identExpr:
+		return []string{string(e)}
+	case negExpr:
+		return exprNames(e.x)
+	case binaryExpr:
+		return append(exprNames(e.x), exprNames(e.y)...)
+	}
+	return nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression in %q", p.s)
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' in %q", p.s)
+		}
+		p.pos++
+		return x, nil
+	case c == '{':
+		end := strings.IndexByte(p.s[p.pos:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missing '}' in %q", p.s)
+		}
+		name := p.s[p.pos+1 : p.pos+end]
+		if name == "" {
+			return nil, fmt.Errorf("empty name at %d in %q", p.pos, p.s)
+		}
+		p.pos += end + 1
+		return identExpr(name), nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in %q", p.s[start:p.pos], p.s)
+		}
+		return numberExpr(v), nil
+	case isIdentStart(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isIdentStart(p.s[p.pos]) || isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return identExpr(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in %q", c, p.pos, p.s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,89 @@
+package mackerelplugin
+
+import (
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	values := map[string]float64{
+		"get_hits":    30,
+		"get_misses":  10,
+		"foo.1.bar":   4,
+		"foo-bar.baz": 2,
+	}
+	lookup := func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1", 1},
+		{"1.5 + 2", 3.5},
+		{"2 * 3 + 4", 10},
+		{"2 * (3 + 4)", 14},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"-3 + 5", 2},
+		{"--3", 3},
+		{"get_hits / (get_hits + get_misses) * 100", 75},
+		{"foo.1.bar * 2", 8},
+		{"{foo-bar.baz} - 1", 1},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.expr, err)
+			continue
+		}
+		v, err := e.eval(lookup)
+		if err != nil {
+			t.Errorf("eval(%q): %v", tt.expr, err)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("eval(%q) = %v; want %v", tt.expr, v, tt.want)
+		}
+	}
+}
+
+func TestParseExprError(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"{foo",
+		"{}",
+		"1..2",
+		"a $ b",
+	}
+	for _, s := range tests {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("parseExpr(%q) should return an error", s)
+		}
+	}
+}
+
+func TestEvalExprError(t *testing.T) {
+	lookup := func(name string) (float64, bool) {
+		if name == "zero" {
+			return 0, true
+		}
+		return 0, false
+	}
+	tests := []string{
+		"1 / zero",
+		"missing + 1",
+	}
+	for _, s := range tests {
+		e, err := parseExpr(s)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", s, err)
+		}
+		if _, err := e.eval(lookup); err == nil {
+			t.Errorf("eval(%q) should return an error", s)
+		}
+	}
+}
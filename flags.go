@@ -0,0 +1,156 @@
+package mackerelplugin
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Flags holds the values of the standard command-line options of plugins.
+type Flags struct {
+	Tempfile        string
+	MetricKeyPrefix string
+	Format          string
+	Timeout         time.Duration
+	Meta            bool
+	Debug           bool
+
+	fs  *flag.FlagSet
+	env map[string]bool // the names of the options given by the environment variables
+}
+
+// Environment variables which give the default values of the standard command-line options
+const (
+	EnvTempfile        = "MACKEREL_PLUGIN_TEMPFILE"
+	EnvMetricKeyPrefix = "MACKEREL_PLUGIN_METRIC_KEY_PREFIX"
+	EnvFormat          = "MACKEREL_PLUGIN_FORMAT"
+	EnvTimeout         = "MACKEREL_PLUGIN_TIMEOUT"
+	EnvMeta            = "MACKEREL_PLUGIN_META"
+)
+
+// RegisterFlags registers the standard command-line options to fs, and returns Flags to hold their values.
+// The default value of each option is taken from the environment variable.
+//
+//	-tempfile           Temp file name ($MACKEREL_PLUGIN_TEMPFILE)
+//	-metric-key-prefix  Metric key prefix ($MACKEREL_PLUGIN_METRIC_KEY_PREFIX)
+//	-format             Output format, text or json ($MACKEREL_PLUGIN_FORMAT)
+//	-timeout            Timeout of fetching metrics ($MACKEREL_PLUGIN_TIMEOUT)
+//	-meta               Output graph definitions ($MACKEREL_PLUGIN_META)
+//	-debug              Log how the value of each metric is computed ($MACKEREL_PLUGIN_DEBUG)
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{
+		Tempfile:        os.Getenv(EnvTempfile),
+		MetricKeyPrefix: os.Getenv(EnvMetricKeyPrefix),
+		Format:          FormatText,
+		fs:              fs,
+		env:             make(map[string]bool),
+	}
+	f.env["tempfile"] = f.Tempfile != ""
+	f.env["metric-key-prefix"] = f.MetricKeyPrefix != ""
+	f.fromEnv("format", EnvFormat, func(s string) error {
+		return (*formatValue)(&f.Format).Set(s)
+	})
+	f.fromEnv("timeout", EnvTimeout, func(s string) error {
+		v, err := time.ParseDuration(s)
+		if err == nil {
+			f.Timeout = v
+		}
+		return err
+	})
+	f.fromEnv("meta", EnvMeta, func(s string) error {
+		v, err := strconv.ParseBool(s)
+		if err == nil {
+			f.Meta = v
+		}
+		return err
+	})
+	f.fromEnv("debug", EnvDebug, func(s string) error {
+		v, err := strconv.ParseBool(s)
+		if err == nil {
+			f.Debug = v
+		}
+		return err
+	})
+
+	fs.StringVar(&f.Tempfile, "tempfile", f.Tempfile, "Temp file name")
+	fs.StringVar(&f.MetricKeyPrefix, "metric-key-prefix", f.MetricKeyPrefix, "Metric key prefix")
+	fs.Var((*formatValue)(&f.Format), "format", "Output format, text or json")
+	fs.DurationVar(&f.Timeout, "timeout", f.Timeout, "Timeout of fetching metrics")
+	fs.BoolVar(&f.Meta, "meta", f.Meta, "Output graph definitions")
+	fs.BoolVar(&f.Debug, "debug", f.Debug, "Log how the value of each metric is computed")
+	return f
+}
+
+// fromEnv sets the option of name by the environment variable env with set if it is not empty.
+// An invalid value is logged and ignored.
+func (f *Flags) fromEnv(name, env string, set func(s string) error) {
+	s := os.Getenv(env)
+	if s == "" {
+		return
+	}
+	if err := set(s); err != nil {
+		log.Printf("RegisterFlags: ignore invalid %s: %v\n", env, err)
+		return
+	}
+	f.env[name] = true
+}
+
+// given reports whether the option of name is given by the command-line or the environment variable.
+// If f is not made by RegisterFlags, the option is regarded as given if it is not zero.
+func (f *Flags) given(name string, zero bool) bool {
+	if f.fs == nil {
+		return !zero
+	}
+	if f.env[name] {
+		return true
+	}
+	given := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// Apply sets the options to h.
+// Only the options given by the command-line or the environment variables are set,
+// so that the fields of h set by the plugin remain as defaults.
+func (f *Flags) Apply(h *MackerelPlugin) {
+	if f.given("tempfile", f.Tempfile == "") {
+		h.Tempfile = f.Tempfile
+	}
+	if f.given("metric-key-prefix", f.MetricKeyPrefix == "") {
+		h.MetricKeyPrefix = f.MetricKeyPrefix
+	}
+	if f.given("format", f.Format == "" || f.Format == FormatText) {
+		h.Format = f.Format
+	}
+	if f.given("timeout", f.Timeout == 0) {
+		h.Timeout = f.Timeout
+	}
+	if f.given("meta", !f.Meta) {
+		h.meta = f.Meta
+	}
+	if f.given("debug", !f.Debug) {
+		h.Debug = f.Debug
+	}
+}
+
+type formatValue string
+
+func (v *formatValue) String() string {
+	return string(*v)
+}
+
+func (v *formatValue) Set(s string) error {
+	switch s {
+	case FormatText, FormatJSON:
+		*v = formatValue(s)
+		return nil
+	}
+	return fmt.Errorf("unknown format: %s", s)
+}
@@ -0,0 +1,127 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	t.Setenv(EnvTempfile, "/tmp/from-env")
+	t.Setenv(EnvTimeout, "5s")
+	t.Setenv(EnvFormat, "unknown")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := RegisterFlags(fs)
+	err := fs.Parse([]string{"-metric-key-prefix", "memcached2", "-format", "json", "-meta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Flags{
+		Tempfile:        "/tmp/from-env",
+		MetricKeyPrefix: "memcached2",
+		Format:          FormatJSON,
+		Timeout:         5 * time.Second,
+		Meta:            true,
+	}
+	got := *f
+	got.fs, got.env = nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RegisterFlags: got %+v; want %+v", got, want)
+	}
+
+	h := NewMackerelPlugin(testP{})
+	f.Apply(&h)
+	if h.Tempfile != "/tmp/from-env" || h.MetricKeyPrefix != "memcached2" || h.Format != FormatJSON || h.Timeout != 5*time.Second || !h.meta {
+		t.Errorf("Apply: got %+v", h)
+	}
+}
+
+func TestApplyOnlyGivenFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-debug"}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewMackerelPlugin(testP{})
+	h.Tempfile = "/tmp/default"
+	h.Format = FormatJSON
+	h.Timeout = 30 * time.Second
+	f.Apply(&h)
+	if h.Tempfile != "/tmp/default" || h.Format != FormatJSON || h.Timeout != 30*time.Second || !h.Debug {
+		t.Errorf("Apply: got %+v", h)
+	}
+
+	t.Setenv(EnvTimeout, "10s")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	f = RegisterFlags(fs)
+	if err := fs.Parse([]string{"-format", "text"}); err != nil {
+		t.Fatal(err)
+	}
+	f.Apply(&h)
+	if h.Format != FormatText || h.Timeout != 10*time.Second || !h.Debug {
+		t.Errorf("Apply: got %+v", h)
+	}
+}
+
+func TestRegisterFlagsWithInvalidEnv(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Setenv(EnvFormat, "xml")
+	t.Setenv(EnvTimeout, "10")
+
+	f := RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	if f.Format != FormatText || f.Timeout != 0 {
+		t.Errorf("RegisterFlags: got %+v", *f)
+	}
+	for _, env := range []string{EnvFormat, EnvTimeout} {
+		if !strings.Contains(buf.String(), env) {
+			t.Errorf("invalid %s is not logged: %s", env, buf.String())
+		}
+	}
+}
+
+func TestRegisterFlagsWithInvalidFormat(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-format", "xml"}); err == nil {
+		t.Error("Parse should return an error for an unknown format")
+	}
+}
+
+type slowPlugin struct {
+	testP
+}
+
+func (slowPlugin) FetchMetrics() (map[string]interface{}, error) {
+	time.Sleep(time.Second)
+	return nil, nil
+}
+
+func TestFetchMetricsTimeout(t *testing.T) {
+	h := NewMackerelPlugin(slowPlugin{})
+	h.Timeout = 10 * time.Millisecond
+	if _, err := h.fetchMetrics(); err == nil {
+		t.Error("fetchMetrics should time out")
+	}
+
+	h = NewMackerelPlugin(testP{})
+	h.Timeout = time.Second
+	stat, err := h.fetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stat) != 2 {
+		t.Errorf("fetchMetrics: got %v", stat)
+	}
+}
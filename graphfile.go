@@ -0,0 +1,96 @@
+package mackerelplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// graphFile is the format of the file of graph definitions.
+// Unlike the output of OutputDefinitions, it includes the fields to compute the values, such as Diff and Type.
+type graphFile struct {
+	Graphs map[string]graphFileGraph `json:"graphs"`
+}
+
+type graphFileGraph struct {
+	Label       string            `json:"label"`
+	Unit        Unit              `json:"unit"`
+	Metrics     []graphFileMetric `json:"metrics"`
+	Aggregates  []Aggregate       `json:"aggregates"`
+	Include     []string          `json:"include"`
+	Exclude     []string          `json:"exclude"`
+	MaxSeries   int               `json:"max_series"`
+	SeriesOrder string            `json:"series_order"`
+}
+
+// graphFileMetric has the same fields as Metrics in the same order, so that it can be converted to Metrics.
+type graphFileMetric struct {
+	Name         string      `json:"name"`
+	Label        string      `json:"label"`
+	Diff         bool        `json:"diff"`
+	Type         MetricType  `json:"type"`
+	Stacked      bool        `json:"stacked"`
+	Scale        float64     `json:"scale"`
+	AbsoluteName bool        `json:"absolute_name"`
+	Divisor      float64     `json:"divisor"`
+	Offset       float64     `json:"offset"`
+	ValueFormat  ValueFormat `json:"value_format"`
+	Expr         string      `json:"expr"`
+	Aggregates   []Aggregate `json:"aggregates"`
+	Warning      string      `json:"warning"`
+	Critical     string      `json:"critical"`
+}
+
+// ParseGraphDefinition parses graph definitions in JSON, and validates them.
+// The keys of the fields are snake_case of the fields of Graphs, Metrics and Aggregate, for example:
+//
+//	{
+//	  "graphs": {
+//	    "memcached.cmd": {
+//	      "label": "Memcached Command",
+//	      "unit": "integer",
+//	      "metrics": [
+//	        {"name": "cmd_get", "label": "Get", "diff": true, "type": "uint64"}
+//	      ]
+//	    }
+//	  }
+//	}
+func ParseGraphDefinition(r io.Reader) (map[string]Graphs, error) {
+	var f graphFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("graph definitions: %w", err)
+	}
+	graphs := make(map[string]Graphs, len(f.Graphs))
+	for key, g := range f.Graphs {
+		graph := Graphs{
+			Label:       g.Label,
+			Unit:        g.Unit,
+			Aggregates:  g.Aggregates,
+			Include:     g.Include,
+			Exclude:     g.Exclude,
+			MaxSeries:   g.MaxSeries,
+			SeriesOrder: g.SeriesOrder,
+		}
+		for _, m := range g.Metrics {
+			graph.Metrics = append(graph.Metrics, Metrics(m))
+		}
+		if err := validateGraph(key, graph); err != nil {
+			return nil, err
+		}
+		graphs[key] = graph
+	}
+	return graphs, nil
+}
+
+// LoadGraphDefinition reads graph definitions from the file of name. See ParseGraphDefinition for the format.
+func LoadGraphDefinition(name string) (map[string]Graphs, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseGraphDefinition(f)
+}
@@ -0,0 +1,114 @@
+package mackerelplugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPJSONPlugin is Plugin which fetches a JSON object from URL, such as a stats endpoint of a service,
+// and flattens it into the values as FlattenJSON does.
+// For example, {"pools": {"web": {"busy": 3}}} is fetched as "pools.web.busy", which is matched by "pools.*" in the graph definitions.
+type HTTPJSONPlugin struct {
+	URL string
+	// Graphs are the graph definitions, which can be loaded by LoadGraphDefinition.
+	Graphs map[string]Graphs
+
+	// Timeout limits the time of the request. Zero means no limit.
+	Timeout time.Duration
+	// Username and Password are used for the basic authentication if Username is not empty.
+	Username string
+	Password string
+	// Header is added to the request.
+	Header http.Header
+	// TLSConfig configures the TLS client, such as RootCAs, certificates for the client authentication or InsecureSkipVerify.
+	TLSConfig *tls.Config
+}
+
+// FetchMetrics fetches the JSON object from p.URL.
+func (p *HTTPJSONPlugin) FetchMetrics() (map[string]interface{}, error) {
+	req := httpRequest{
+		url:       p.URL,
+		accept:    "application/json",
+		timeout:   p.Timeout,
+		username:  p.Username,
+		password:  p.Password,
+		header:    p.Header,
+		tlsConfig: p.TLSConfig,
+	}
+	var stat map[string]interface{}
+	err := req.do(func(r io.Reader) (err error) {
+		stat, err = FlattenJSON(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// GraphDefinition returns p.Graphs.
+func (p *HTTPJSONPlugin) GraphDefinition() map[string]Graphs {
+	return p.Graphs
+}
+
+// httpRequest is a GET request to fetch stats.
+type httpRequest struct {
+	url       string
+	accept    string
+	timeout   time.Duration
+	username  string
+	password  string
+	header    http.Header
+	tlsConfig *tls.Config
+}
+
+// do sends the request, and calls read with the body if the status is 200.
+// The errors are prefixed with the URL.
+func (req httpRequest) do(read func(r io.Reader) error) error {
+	ctx := context.Background()
+	if req.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.timeout)
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, req.url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range req.header {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	if req.accept != "" {
+		r.Header.Set("Accept", req.accept)
+	}
+	if req.username != "" {
+		r.SetBasicAuth(req.username, req.password)
+	}
+
+	client := http.DefaultClient
+	if req.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = req.tlsConfig
+		client = &http.Client{Transport: transport}
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", req.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := read(resp.Body); err != nil {
+		return fmt.Errorf("%s: %w", req.url, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package mackerelplugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/go-mackerel-plugin-helper/internal/memstate"
+)
+
+const statsJSON = `{"uptime": 3600, "pools": {"web": {"busy": 3, "idle": 5}, "api": {"busy": 1, "idle": 7}}}`
+
+func TestHTTPJSONPlugin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Token") != "token" {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, statsJSON)
+	}))
+	defer srv.Close()
+
+	p := &HTTPJSONPlugin{
+		URL:      srv.URL,
+		Username: "admin",
+		Password: "secret",
+		Header:   http.Header{"X-Token": {"token"}},
+		Graphs: map[string]Graphs{
+			"pools.*": {Metrics: []Metrics{{Name: "busy"}, {Name: "idle"}}},
+		},
+	}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"uptime":         "3600",
+		"pools.web.busy": "3",
+		"pools.web.idle": "5",
+		"pools.api.busy": "1",
+		"pools.api.idle": "7",
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics() = %v; want %v", stat, want)
+	}
+
+	h := NewMackerelPlugin(p)
+	h.StateStore = &memstate.State{}
+	got := make(map[string]interface{})
+	err = h.collectValues(func(key string, value interface{}, now time.Time) { got[key] = value })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["pools.web.busy"] != 3.0 || got["pools.api.idle"] != 7.0 {
+		t.Errorf("collectValues: got %v", got)
+	}
+
+	p.Password = "wrong"
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics() should return an error for 401")
+	}
+}
+
+func TestHTTPJSONPluginTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	p := &HTTPJSONPlugin{URL: srv.URL, Timeout: 10 * time.Millisecond}
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics() should time out")
+	}
+}
+
+func TestHTTPJSONPluginTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, statsJSON)
+	}))
+	defer srv.Close()
+
+	p := &HTTPJSONPlugin{URL: srv.URL}
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics() should fail to verify the certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	p.TLSConfig = &tls.Config{RootCAs: pool}
+	if _, err := p.FetchMetrics(); err != nil {
+		t.Errorf("FetchMetrics() with RootCAs: %v", err)
+	}
+
+	p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if _, err := p.FetchMetrics(); err != nil {
+		t.Errorf("FetchMetrics() with InsecureSkipVerify: %v", err)
+	}
+}
+
+func TestHTTPJSONPluginInvalidJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[1, 2, 3]`)
+	}))
+	defer srv.Close()
+
+	p := &HTTPJSONPlugin{URL: srv.URL}
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics() should return an error for a JSON array")
+	}
+}
@@ -0,0 +1,31 @@
+// Package memstate provides the state store in memory which is shared by mackerelplugin and plugintest.
+package memstate
+
+import (
+	"io/fs"
+	"sync"
+)
+
+// State is a StateStore in memory.
+type State struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// Load returns the stored state.
+func (s *State) Load() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte(nil), s.data...), nil
+}
+
+// Save stores data.
+func (s *State) Save(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append([]byte{}, data...)
+	return nil
+}
@@ -1,16 +1,19 @@
 package mackerelplugin
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,26 +26,143 @@ import (
 
 // Metrics represents definition of a metric
 type Metrics struct {
-	Name         string  `json:"name"`
-	Label        string  `json:"label"`
-	Diff         bool    `json:"-"`
-	Type         string  `json:"-"`
-	Stacked      bool    `json:"stacked"`
-	Scale        float64 `json:"-"`
-	AbsoluteName bool    `json:"-"`
+	Name         string     `json:"name"`
+	Label        string     `json:"label"`
+	Diff         bool       `json:"-"`
+	Type         MetricType `json:"-"`
+	Stacked      bool       `json:"stacked"`
+	Scale        float64    `json:"-"`
+	AbsoluteName bool       `json:"-"`
+
+	// Divisor divides the value after Scale is applied, and Offset is added to the result.
+	// For example, Divisor 1024 converts bytes to KiB, and Offset -273.15 converts Kelvin to Celsius.
+	Divisor float64 `json:"-"`
+	Offset  float64 `json:"-"`
+
+	// ValueFormat is the format of string values, such as sizes or durations, which are parsed into the base unit.
+	ValueFormat ValueFormat `json:"-"`
+
+	// Expr makes the metric a derived one whose value is computed from other metrics.
+	// See README for the syntax.
+	Expr string `json:"-"`
+
+	// Aggregates are series aggregated over the values matched by the wildcard in the metric.
+	Aggregates []Aggregate `json:"-"`
+
+	// Warning and Critical are the thresholds of the metric in the check mode. See Threshold.
+	Warning  string `json:"-"`
+	Critical string `json:"-"`
 }
 
 // Graphs represents definition of a graph
 type Graphs struct {
 	Label   string    `json:"label"`
-	Unit    string    `json:"unit"`
+	Unit    Unit      `json:"unit"`
 	Metrics []Metrics `json:"metrics"`
+
+	// Aggregates are applied to every metrics that contain the wildcard in the graph.
+	Aggregates []Aggregate `json:"-"`
+
+	// Include and Exclude are regular expressions to filter series by the segments matched by the wildcard.
+	// If Include is not empty, only the series matching to any of them are output.
+	Include []string `json:"-"`
+	Exclude []string `json:"-"`
+
+	// MaxSeries limits the number of series matched by the wildcard. Zero means no limit.
+	MaxSeries int `json:"-"`
+	// SeriesOrder decides which series are kept when the number of series exceeds MaxSeries.
+	SeriesOrder string `json:"-"`
+}
+
+// Orders of series
+const (
+	// SeriesOrderName keeps the series in lexical order of the matched segments. It is the default.
+	SeriesOrderName = "name"
+	// SeriesOrderValue keeps the series with the largest sum of values in the graph.
+	SeriesOrderValue = "value"
+)
+
+// Aggregate functions
+const (
+	AggregateSum   = "sum"
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateCount = "count"
+)
+
+// Aggregate represents a series aggregated over the values matched by a wildcard.
+type Aggregate struct {
+	// Func is one of AggregateSum, AggregateAvg, AggregateMin, AggregateMax or AggregateCount.
+	Func string
+	// Name replaces the wildcards in the metric name to make the key of the series.
+	// If Name is empty, Func is used.
+	Name string
+	// Warning and Critical are the thresholds of the aggregated series in the check mode.
+	// The thresholds of the metric are not applied to it.
+	Warning  string
+	Critical string
+}
+
+// Unit is the unit of a graph. The default is UnitFloat.
+type Unit string
+
+// Units which Mackerel supports
+const (
+	UnitFloat          Unit = "float"
+	UnitInteger        Unit = "integer"
+	UnitPercentage     Unit = "percentage"
+	UnitSeconds        Unit = "seconds"
+	UnitMilliseconds   Unit = "milliseconds"
+	UnitBytes          Unit = "bytes"
+	UnitBytesPerSecond Unit = "bytes/sec"
+	UnitBitsPerSecond  Unit = "bits/sec"
+	UnitIOPS           Unit = "iops"
+)
+
+func (u Unit) valid() bool {
+	switch u {
+	case "", UnitFloat, UnitInteger, UnitPercentage, UnitSeconds, UnitMilliseconds,
+		UnitBytes, UnitBytesPerSecond, UnitBitsPerSecond, UnitIOPS:
+		return true
+	}
+	return false
+}
+
+// MetricType is the type of the values of a metric.
+type MetricType string
+
+// Types of metrics. The default is Float64.
+const (
+	Float64 MetricType = "float64"
+	Uint32  MetricType = "uint32"
+	Uint64  MetricType = "uint64"
+)
+
+func (t MetricType) valid() bool {
+	switch t {
+	case "", Float64, Uint32, Uint64:
+		return true
+	}
+	return false
 }
 
 // MetricValues represents a collection of metric values and its timestamp
 type MetricValues struct {
 	Values    map[string]interface{}
 	Timestamp time.Time
+
+	// LastSeen holds the times when the values were fetched if they differ from Timestamp,
+	// such as ones kept by StateTTL or recorded with MetricSet.SetTime.
+	LastSeen map[string]time.Time
+}
+
+// timestampOf returns the time when the value of name was fetched.
+func (m MetricValues) timestampOf(name string) time.Time {
+	if t, ok := m.LastSeen[name]; ok {
+		return t
+	}
+	return m.Timestamp
 }
 
 // Plugin is old interface of mackerel-plugin
@@ -57,11 +177,75 @@ type PluginWithPrefix interface {
 	MetricKeyPrefix() string
 }
 
+// StateStore stores the state of a plugin between runs.
+type StateStore interface {
+	// Load returns the stored state, or an error wrapping fs.ErrNotExist if nothing is stored.
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// Clock gives the current time.
+type Clock interface {
+	Now() time.Time
+}
+
 // MackerelPlugin is for mackerel-agent-plugin
 type MackerelPlugin struct {
 	Plugin
 	Tempfile string
-	diff     *bool
+
+	// StateTTL makes the values, which are not fetched, be kept in Tempfile until StateTTL has passed since they were fetched last.
+	// If StateTTL is zero, only the values fetched at the last time are kept.
+	StateTTL time.Duration
+
+	// Thresholds are used in the check mode in addition to Warning and Critical of Metrics.
+	Thresholds []Threshold
+
+	// Timeout limits the time of FetchMetrics. Zero means no limit.
+	Timeout time.Duration
+
+	// Debug makes the helper log how the value of each metric is computed.
+	// It is also enabled by the environment variable MACKEREL_PLUGIN_DEBUG.
+	Debug bool
+
+	// MetricKeyPrefix overrides the prefix given by PluginWithPrefix if it is not empty.
+	// For a plugin which implements only Plugin, it is prepended to the keys of the graphs.
+	MetricKeyPrefix string
+
+	// Format is the format of the values output by OutputValues, FormatText or FormatJSON.
+	// The default is FormatText.
+	Format string
+
+	// ReportFetchErrors makes the helper output the number of errors in PartialError returned by FetchMetrics
+	// as plugin_helper.fetch.errors.
+	ReportFetchErrors bool
+
+	// SelfMetrics makes the helper output the metrics about the plugin itself as plugin_helper.self.*,
+	// such as the duration of FetchMetrics and the number of skipped values.
+	SelfMetrics bool
+
+	// SkipUnparsableValues makes the helper skip string values which cannot be parsed.
+	// By default they are regarded as 0 for compatibility.
+	SkipUnparsableValues bool
+
+	// StateStore stores the values to calculate differentials instead of Tempfile if it is not nil.
+	StateStore StateStore
+
+	// Clock gives the time of each run, which is used for the timestamps, the differentials, StateTTL and the self metrics.
+	// If it is nil, the system clock is used. Timeout is always measured by the system clock.
+	Clock Clock
+
+	diff *bool
+	meta bool
+
+	// output receives the computed values instead of printing them if it is not nil.
+	output func(key string, value interface{}, now time.Time)
+
+	// stats records the metrics about the plugin itself during collectValues if SelfMetrics is true.
+	stats *selfStats
+
+	// aggregated records the keys of the aggregated series during collectValues if it is not nil.
+	aggregated map[string]bool
 }
 
 // NewMackerelPlugin returns new MackerelPlugin struct
@@ -87,6 +271,14 @@ func (h *MackerelPlugin) hasDiff() bool {
 	return *h.diff
 }
 
+// Formats of the values
+const (
+	// FormatText is the format which mackerel-agent accepts: "key\tvalue\ttimestamp".
+	FormatText = "text"
+	// FormatJSON outputs each value as a JSON object in a line.
+	FormatJSON = "json"
+)
+
 func (h *MackerelPlugin) printValue(w io.Writer, key string, value interface{}, now time.Time) {
 	switch v := value.(type) {
 	case uint32:
@@ -102,6 +294,49 @@ func (h *MackerelPlugin) printValue(w io.Writer, key string, value interface{},
 	}
 }
 
+// stateVersion is the version of the format of Tempfile.
+// Tempfile of version 1 is a flat object of the fetched values and "_lastTime".
+const stateVersion = 2
+
+// state is the format of Tempfile.
+type state struct {
+	Version  int                    `json:"version"`
+	LastTime int64                  `json:"lastTime"`
+	Values   map[string]interface{} `json:"values"`
+	LastSeen map[string]int64       `json:"lastSeen,omitempty"`
+}
+
+func (h *MackerelPlugin) printJSONValue(w io.Writer, key string, value interface{}, now time.Time) {
+	if v, ok := value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		log.Printf("Invalid value: key = %s, value = %f\n", key, v)
+		return
+	}
+	b, err := json.Marshal(struct {
+		Key       string      `json:"key"`
+		Value     interface{} `json:"value"`
+		Timestamp int64       `json:"timestamp"`
+	}{key, value, now.Unix()})
+	if err != nil {
+		log.Printf("Invalid value: key = %s, value = %v\n", key, value)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// outputValue prints the value of key, or passes it to h.output.
+func (h *MackerelPlugin) outputValue(key string, value interface{}, now time.Time) {
+	if v, ok := value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		h.stats.skip(skipInvalidFloat)
+	} else {
+		h.stats.emit()
+	}
+	if h.output != nil {
+		h.output(key, value, now)
+		return
+	}
+	h.printValue(os.Stdout, key, value, now)
+}
+
 // FetchLastValues retrieves the last recorded metric value
 // if there is the graph-def that is set Diff to true in the result of h.GraphDefinition().
 func (h *MackerelPlugin) FetchLastValues() (metricValues MetricValues, err error) {
@@ -109,17 +344,76 @@ func (h *MackerelPlugin) FetchLastValues() (metricValues MetricValues, err error
 		return
 	}
 
-	f, err := os.Open(h.tempfilename())
+	data, err := h.loadState()
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return metricValues, nil
 		}
 		return
 	}
-	defer f.Close()
+	return decodeState(data)
+}
+
+func decodeState(data []byte) (metricValues MetricValues, err error) {
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return
+	}
+	if _, ok := raw["_lastTime"]; ok {
+		return decodeLegacyState(data)
+	}
+
+	var st state
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&st); err != nil {
+		return
+	}
+	for k, v := range st.Values {
+		st.Values[k] = stateNumber(v)
+	}
+	if st.Version != stateVersion {
+		return metricValues, fmt.Errorf("unsupported state version: %d", st.Version)
+	}
+	metricValues.Values = st.Values
+	if metricValues.Values == nil {
+		metricValues.Values = make(map[string]interface{})
+	}
+	// for compatibility with version 1
+	metricValues.Values["_lastTime"] = float64(st.LastTime)
+	metricValues.Timestamp = time.Unix(st.LastTime, 0)
+	if len(st.LastSeen) > 0 {
+		metricValues.LastSeen = make(map[string]time.Time, len(st.LastSeen))
+		for k, t := range st.LastSeen {
+			metricValues.LastSeen[k] = time.Unix(t, 0)
+		}
+	}
+	return
+}
+
+// stateNumber converts v decoded as json.Number to float64,
+// or to uint64 if it is an integer which float64 cannot represent exactly, such as a counter near overflow.
+func stateNumber(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	f, err := n.Float64()
+	if f >= 1<<53 {
+		if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return u
+		}
+	}
+	if err != nil {
+		return v
+	}
+	return f
+}
 
-	decoder := json.NewDecoder(f)
-	err = decoder.Decode(&metricValues.Values)
+// decodeLegacyState decodes Tempfile of version 1.
+// It will be rewritten in the current version by saveValues.
+func decodeLegacyState(data []byte) (metricValues MetricValues, err error) {
+	err = json.Unmarshal(data, &metricValues.Values)
 	if err != nil {
 		return
 	}
@@ -139,7 +433,13 @@ func (h *MackerelPlugin) fetchLastValuesSafe(now time.Time) (metricValues Metric
 	if err != nil {
 		return m, err
 	}
-	if now.Sub(m.Timestamp) < time.Second {
+	elapsed := now.Sub(m.Timestamp)
+	if elapsed < 0 {
+		// The clock went backwards, so the differentials from the last values are meaningless.
+		log.Printf("FetchLastValues: the last values at %d are in the future, and are discarded\n", m.Timestamp.Unix())
+		return MetricValues{}, nil
+	}
+	if elapsed < time.Second {
 		return m, errStateUpdated
 	}
 	return m, nil
@@ -149,55 +449,159 @@ func (h *MackerelPlugin) saveValues(metricValues MetricValues) error {
 	if !h.hasDiff() {
 		return nil
 	}
-	fname := h.tempfilename()
-	f, err := os.Create(fname)
-	if err != nil {
-		return err
+	st := state{
+		Version:  stateVersion,
+		LastTime: metricValues.Timestamp.Unix(),
+		Values:   make(map[string]interface{}),
 	}
-	defer f.Close()
-
-	// Since Go 1.15 strconv.ParseFloat returns +Inf if it couldn't parse a string.
-	// But JSON does not accept invalid numbers, such as +Inf, -Inf or NaN.
-	// We perhaps have some plugins that is affected above change,
-	// so saveState should clear invalid numbers in the values before saving it.
+	// Only the values which are needed to calculate differentials are saved.
+	isStateKey := h.stateKeyMatcher()
 	for k, v := range metricValues.Values {
-		f, ok := v.(float64)
-		if !ok {
+		if !isStateKey(strings.TrimPrefix(k, ".last_diff.")) {
 			continue
 		}
-		if math.IsInf(f, 0) || math.IsNaN(f) {
-			delete(metricValues.Values, k)
+		// Since Go 1.15 strconv.ParseFloat returns +Inf if it couldn't parse a string.
+		// But JSON does not accept invalid numbers, such as +Inf, -Inf or NaN.
+		// We perhaps have some plugins that is affected above change,
+		// so saveState should clear invalid numbers in the values before saving it.
+		if f, ok := v.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			continue
+		}
+		st.Values[k] = v
+		if t, ok := metricValues.LastSeen[k]; ok {
+			if st.LastSeen == nil {
+				st.LastSeen = make(map[string]int64)
+			}
+			st.LastSeen[k] = t.Unix()
 		}
 	}
 
-	metricValues.Values["_lastTime"] = metricValues.Timestamp.Unix()
-	encoder := json.NewEncoder(f)
-	err = encoder.Encode(metricValues.Values)
+	data, err := json.Marshal(st)
 	if err != nil {
 		return err
 	}
-
+	data = append(data, '\n')
+	if err := h.storeState(data); err != nil {
+		return err
+	}
+	h.stats.stored(len(data))
 	return nil
 }
 
-func (h *MackerelPlugin) calcDiff(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
+// loadState reads the state from h.StateStore or Tempfile.
+func (h *MackerelPlugin) loadState() ([]byte, error) {
+	if h.StateStore != nil {
+		return h.StateStore.Load()
+	}
+	return os.ReadFile(h.tempfilename())
+}
+
+// storeState writes the state to h.StateStore or Tempfile.
+func (h *MackerelPlugin) storeState(data []byte) error {
+	if h.StateStore != nil {
+		return h.StateStore.Save(data)
+	}
+	return os.WriteFile(h.tempfilename(), data, 0666)
+}
+
+// stateKeyMatcher returns a function which reports whether the value of name is needed to calculate differentials.
+func (h *MackerelPlugin) stateKeyMatcher() func(name string) bool {
+	return h.metricMatcher(func(metric Metrics) bool {
+		return metric.Diff && metric.Expr == ""
+	})
+}
+
+// metricMatcher returns a function which reports whether name is the name of a value of the metrics accepted by filter,
+// including ones matched by the wildcard.
+func (h *MackerelPlugin) metricMatcher(filter func(metric Metrics) bool) func(name string) bool {
+	names := make(map[string]bool)
+	var patterns []*regexp.Regexp
+	for key, graph := range h.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			if !filter(metric) {
+				continue
+			}
+			if strings.ContainsAny(key+metric.Name, "*#") {
+				patterns = append(patterns, wildcardRegexp(key, metric))
+			} else {
+				names[valueName(key, metric)] = true
+			}
+		}
+	}
+	return func(name string) bool {
+		if names[name] {
+			return true
+		}
+		for _, re := range patterns {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// carryOverValues copies the values in lastMetricValues, which are not in metricValues, to metricValues
+// unless h.StateTTL has passed since they were fetched. It returns the number of expired values.
+func (h *MackerelPlugin) carryOverValues(metricValues *MetricValues, lastMetricValues MetricValues) int {
+	if metricValues.Values == nil {
+		metricValues.Values = make(map[string]interface{})
+	}
+	expired := 0
+	for k, v := range lastMetricValues.Values {
+		if k == "_lastTime" {
+			continue
+		}
+		if _, ok := metricValues.Values[k]; ok {
+			continue
+		}
+		seen := lastMetricValues.timestampOf(k)
+		if metricValues.Timestamp.Sub(seen) > h.StateTTL {
+			expired++
+			continue
+		}
+		metricValues.Values[k] = v
+		if metricValues.LastSeen == nil {
+			metricValues.LastSeen = make(map[string]time.Time)
+		}
+		metricValues.LastSeen[k] = seen
+	}
+	return expired
+}
+
+var errCounterReset = errors.New("counter seems to be reset")
+
+// diffInterval returns the seconds between lastTime and now to calculate a differential.
+// It returns an error if they are too far apart, or if the clock did not advance.
+func diffInterval(now time.Time, lastTime time.Time) (int64, error) {
 	diffTime := now.Unix() - lastTime.Unix()
 	if diffTime > 600 {
 		return 0, errors.New("too long duration")
 	}
+	if diffTime <= 0 {
+		return 0, fmt.Errorf("clock did not advance from %d to %d", lastTime.Unix(), now.Unix())
+	}
+	return diffTime, nil
+}
+
+func (h *MackerelPlugin) calcDiff(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
+	diffTime, err := diffInterval(now, lastTime)
+	if err != nil {
+		return 0, err
+	}
 
 	diff := (value - lastValue) * 60 / float64(diffTime)
 
 	if lastValue <= value {
 		return diff, nil
 	}
-	return 0.0, errors.New("counter seems to be reset")
+	return 0.0, errCounterReset
 }
 
 func (h *MackerelPlugin) calcDiffUint32(value uint32, now time.Time, lastValue uint32, lastTime time.Time, lastDiff float64) (float64, error) {
-	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+	diffTime, err := diffInterval(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
 
 	diff := float64((value-lastValue)*60) / float64(diffTime)
@@ -205,14 +609,14 @@ func (h *MackerelPlugin) calcDiffUint32(value uint32, now time.Time, lastValue u
 	if lastValue <= value || diff < lastDiff*10 {
 		return diff, nil
 	}
-	return 0.0, errors.New("counter seems to be reset")
+	return 0.0, errCounterReset
 
 }
 
 func (h *MackerelPlugin) calcDiffUint64(value uint64, now time.Time, lastValue uint64, lastTime time.Time, lastDiff float64) (float64, error) {
-	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+	diffTime, err := diffInterval(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
 
 	diff := float64((value-lastValue)*60) / float64(diffTime)
@@ -220,7 +624,7 @@ func (h *MackerelPlugin) calcDiffUint64(value uint64, now time.Time, lastValue u
 	if lastValue <= value || diff < lastDiff*10 {
 		return diff, nil
 	}
-	return 0.0, errors.New("counter seems to be reset")
+	return 0.0, errCounterReset
 }
 
 func (h *MackerelPlugin) tempfilename() string {
@@ -237,12 +641,21 @@ func (h *MackerelPlugin) SetTempfileByBasename(base string) {
 	h.Tempfile = filepath.Join(pluginutil.PluginWorkDir(), base)
 }
 
+// metricKeyPrefix returns the prefix of the metric keys, and whether the plugin has the prefix.
+func (h *MackerelPlugin) metricKeyPrefix() (string, bool) {
+	if h.MetricKeyPrefix != "" {
+		return h.MetricKeyPrefix, true
+	}
+	if p, ok := h.Plugin.(PluginWithPrefix); ok {
+		return p.MetricKeyPrefix(), true
+	}
+	return "", false
+}
+
 func (h *MackerelPlugin) generateTempfilePath(args []string) string {
 	commandPath := args[0]
-	var prefix string
-	if p, ok := h.Plugin.(PluginWithPrefix); ok {
-		prefix = p.MetricKeyPrefix()
-	} else {
+	prefix, ok := h.metricKeyPrefix()
+	if !ok {
 		name := filepath.Base(commandPath)
 		prefix = strings.TrimPrefix(tempfileSanitizeReg.ReplaceAllString(name, "_"), "mackerel-plugin-")
 	}
@@ -256,109 +669,479 @@ func (h *MackerelPlugin) generateTempfilePath(args []string) string {
 	return filepath.Join(pluginutil.PluginWorkDir(), filename)
 }
 
-const (
-	metricTypeUint32 = "uint32"
-	metricTypeUint64 = "uint64"
-	// metricTypeFloat  = "float64"
-)
-
-func (h *MackerelPlugin) formatValues(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues) {
-	name := metric.Name
+func valueName(prefix string, metric Metrics) string {
 	if metric.AbsoluteName && len(prefix) > 0 {
-		name = prefix + "." + name
+		return prefix + "." + metric.Name
 	}
+	return metric.Name
+}
+
+// formatValues prints the value of metric, and returns the printed value.
+func (h *MackerelPlugin) formatValues(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues) (interface{}, bool) {
+	ex := h.explain(h.metricKey(prefix, metric.Name))
+	value, ok := h.computeValue(prefix, metric, metricValues, lastMetricValues, ex)
+	if !ok {
+		return nil, false
+	}
+	ex.output(value)
+	h.outputValue(h.metricKey(prefix, metric.Name), value, metricValues.timestampOf(valueName(prefix, metric)))
+	return value, true
+}
+
+// computeValue returns the value of metric to output.
+// The steps are added to ex, which the caller flushes when the value is output,
+// while ex is flushed here if the value is dropped.
+func (h *MackerelPlugin) computeValue(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues, ex *explanation) (interface{}, bool) {
+	name := valueName(prefix, metric)
+	ex.add("name=%s", name)
 	value, ok := metricValues.Values[name]
 	if !ok || value == nil {
-		return
+		ex.drop("not fetched")
+		h.stats.skip(skipMissing)
+		return nil, false
+	}
+	if v, ok := value.(string); ok {
+		ex.add("raw=%q", v)
+	} else {
+		ex.add("raw=%v", value)
+	}
+	if !metric.Type.valid() {
+		ex.add("unknown type %q is regarded as float64", metric.Type)
 	}
 
-	var err error
 	if v, ok := value.(string); ok {
-		switch metric.Type {
-		case metricTypeUint32:
-			value, err = strconv.ParseUint(v, 10, 32)
-		case metricTypeUint64:
-			value, err = strconv.ParseUint(v, 10, 64)
-		default:
-			value, err = strconv.ParseFloat(v, 64)
+		var err error
+		value, err = parseMetricValue(v, metric)
+		if err != nil {
+			log.Println("Parsing a value: ", err)
+			h.stats.skip(skipParseError)
+			if h.SkipUnparsableValues {
+				// The value must not be used as the last value at the next time either.
+				delete(metricValues.Values, name)
+				ex.drop(fmt.Sprintf("parse error (%v)", err))
+				return nil, false
+			}
+			// For keeping compatibility, the value is set to 0 and continue.
+			value = zeroValue(metric.Type)
+			ex.add("parse error (%v)", err)
 		}
 	}
-	if err != nil {
-		// For keeping compatibility, if each above statement occurred the error,
-		// then the value is set to 0 and continue.
-		log.Println("Parsing a value: ", err)
-	}
+	ex.add("parsed=%v (%T)", value, value)
 
 	if metric.Diff {
-		_, ok := lastMetricValues.Values[name]
+		lastValue, ok := lastMetricValues.Values[name]
 		if ok {
+			// The last value is saved as fetched, so it is parsed in the same way.
+			if v, isString := lastValue.(string); isString && metric.ValueFormat != ValueFormatNumber {
+				lastValue, _ = parseMetricValue(v, metric)
+			}
 			var lastDiff float64
 			if lastMetricValues.Values[".last_diff."+name] != nil {
 				lastDiff = toFloat64(lastMetricValues.Values[".last_diff."+name])
 			}
+			ex.add("last=%v at %d, last_diff=%v", lastMetricValues.Values[name], lastMetricValues.timestampOf(name).Unix(), lastDiff)
 			var err error
 			switch metric.Type {
-			case metricTypeUint32:
-				value, err = h.calcDiffUint32(toUint32(value), metricValues.Timestamp, toUint32(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff)
-			case metricTypeUint64:
-				value, err = h.calcDiffUint64(toUint64(value), metricValues.Timestamp, toUint64(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff)
+			case Uint32:
+				value, err = h.calcDiffUint32(toUint32(value), metricValues.timestampOf(name), toUint32(lastValue), lastMetricValues.timestampOf(name), lastDiff)
+			case Uint64:
+				value, err = h.calcDiffUint64(toUint64(value), metricValues.timestampOf(name), toUint64(lastValue), lastMetricValues.timestampOf(name), lastDiff)
 			default:
-				value, err = h.calcDiff(toFloat64(value), metricValues.Timestamp, toFloat64(lastMetricValues.Values[name]), lastMetricValues.Timestamp)
+				value, err = h.calcDiff(toFloat64(value), metricValues.timestampOf(name), toFloat64(lastValue), lastMetricValues.timestampOf(name))
 			}
 			if err != nil {
 				log.Println("OutputValues: ", err)
-				return
+				ex.drop(err.Error())
+				if errors.Is(err, errCounterReset) {
+					h.stats.skip(skipReset)
+				} else {
+					h.stats.skip(skipMissing)
+				}
+				return nil, false
 			}
+			ex.add("diff=%v", value)
 			metricValues.Values[".last_diff."+name] = value
 		} else {
 			log.Printf("%s does not exist at last fetch\n", name)
-			return
+			ex.drop("does not exist at last fetch")
+			h.stats.skip(skipMissing)
+			return nil, false
 		}
 	}
 
-	if metric.Scale != 0 {
-		switch metric.Type {
-		case metricTypeUint32:
-			value = toUint32(value) * uint32(metric.Scale)
-		case metricTypeUint64:
-			value = toUint64(value) * uint64(metric.Scale)
-		default:
-			value = toFloat64(value) * metric.Scale
+	value = scaleValue(value, metric, ex)
+	return value, true
+}
+
+// scaleValue applies Scale, Divisor and Offset of metric to value.
+// A value of an integer type is kept in the type if Scale is a whole number and neither Divisor nor Offset is set,
+// otherwise it is converted to float64 so that a fractional factor does not truncate it.
+func scaleValue(value interface{}, metric Metrics, ex *explanation) interface{} {
+	if metric.Scale == 0 && metric.Divisor == 0 && metric.Offset == 0 {
+		return value
+	}
+	integral := metric.Scale >= 0 && metric.Scale == math.Trunc(metric.Scale) && metric.Divisor == 0 && metric.Offset == 0
+	switch {
+	case integral && metric.Type == Uint32:
+		value = toUint32(value) * uint32(metric.Scale)
+	case integral && metric.Type == Uint64:
+		value = toUint64(value) * uint64(metric.Scale)
+	default:
+		v := toFloat64(value)
+		if metric.Scale != 0 {
+			v *= metric.Scale
+		}
+		if metric.Divisor != 0 {
+			v /= metric.Divisor
 		}
+		value = v + metric.Offset
+	}
+	if metric.Scale != 0 {
+		ex.add("scale=%v", metric.Scale)
+	}
+	if metric.Divisor != 0 {
+		ex.add("divisor=%v", metric.Divisor)
+	}
+	if metric.Offset != 0 {
+		ex.add("offset=%v", metric.Offset)
 	}
+	return value
+}
 
+// metricKey returns the key of the metric to output.
+func (h *MackerelPlugin) metricKey(prefix string, name string) string {
 	metricNames := []string{}
-	if p, ok := h.Plugin.(PluginWithPrefix); ok {
-		metricNames = append(metricNames, p.MetricKeyPrefix())
+	if p, ok := h.metricKeyPrefix(); ok {
+		metricNames = append(metricNames, p)
 	}
 	if len(prefix) > 0 {
 		metricNames = append(metricNames, prefix)
 	}
-	metricNames = append(metricNames, metric.Name)
-	h.printValue(os.Stdout, strings.Join(metricNames, "."), value, metricValues.Timestamp)
+	metricNames = append(metricNames, name)
+	return strings.Join(metricNames, ".")
+}
+
+// refersToAny reports whether the expression s refers to any of names.
+func refersToAny(s string, names map[string]bool) bool {
+	e, err := parseExpr(s)
+	if err != nil {
+		return false
+	}
+	for _, name := range exprNames(e) {
+		if names[name] {
+			return true
+		}
+	}
+	return false
 }
 
-func (h *MackerelPlugin) formatValuesWithWildcard(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues) {
+// formatDerivedValues evaluates metric.Expr and prints the result.
+// Names in the expression are resolved to the values computed in the same fetch, including other derived metrics,
+// or to the fetched values if no metric with the name is defined, which is reported by defined.
+// A defined metric which is not computed, such as a counter at the first run, fails the evaluation.
+func (h *MackerelPlugin) formatDerivedValues(prefix string, metric Metrics, metricValues MetricValues, computed map[string]interface{}, defined func(name string) bool) (interface{}, bool) {
+	key := h.metricKey(prefix, metric.Name)
+	ex := h.explain(key)
+	ex.add("expr=%s", metric.Expr)
+	e, err := parseExpr(metric.Expr)
+	if err != nil {
+		log.Printf("Failed to parse the expression of %s: %v\n", metric.Name, err)
+		ex.drop(err.Error())
+		return nil, false
+	}
+	var notComputed string
+	value, err := e.eval(func(name string) (float64, bool) {
+		if v, ok := computed[name]; ok {
+			return toFloat64(v), true
+		}
+		if defined != nil && defined(name) {
+			// The raw value of the metric, such as a counter, is not what the metric means.
+			notComputed = name
+			return 0, false
+		}
+		v, ok := metricValues.Values[name]
+		if !ok || v == nil {
+			return 0, false
+		}
+		if s, ok := v.(string); ok {
+			f, err := parseNumber(s, Float64)
+			if err != nil {
+				return 0, false
+			}
+			return f.(float64), true
+		}
+		return toFloat64(v), true
+	})
+	if err != nil {
+		if notComputed != "" {
+			ex.drop(fmt.Sprintf("%s is not output in this run", notComputed))
+			return nil, false
+		}
+		log.Printf("Failed to evaluate the expression of %s: %v\n", metric.Name, err)
+		ex.drop(err.Error())
+		return nil, false
+	}
+	// The value of a derived metric is always float64 regardless of Type.
+	floatMetric := metric
+	floatMetric.Type = Float64
+	value = scaleValue(value, floatMetric, ex).(float64)
+	ex.output(value)
+	h.outputValue(key, value, metricValues.Timestamp)
+	return value, true
+}
+
+// wildcardRegexp returns the regular expression to match the names of metric containing the wildcard.
+// Each segment matched by the wildcard is captured.
+func wildcardRegexp(prefix string, metric Metrics) *regexp.Regexp {
 	regexpStr := `\A` + prefix + "." + metric.Name
 	regexpStr = strings.ReplaceAll(regexpStr, ".", "\\.")
-	regexpStr = strings.ReplaceAll(regexpStr, "*", "[-a-zA-Z0-9_]+")
-	regexpStr = strings.ReplaceAll(regexpStr, "#", "[-a-zA-Z0-9_]+")
+	regexpStr = strings.ReplaceAll(regexpStr, "*", "([-a-zA-Z0-9_]+)")
+	regexpStr = strings.ReplaceAll(regexpStr, "#", "([-a-zA-Z0-9_]+)")
 	re, err := regexp.Compile(regexpStr)
 	if err != nil {
 		log.Fatalln("Failed to compile regexp: ", err)
 	}
+	return re
+}
+
+type wildcardValue struct {
+	segment string // the part matched by the wildcards
+	value   interface{}
+	ex      *explanation
+}
+
+// computeValuesWithWildcard returns the values of metrics matching to the wildcard by their names.
+// If filter is not nil, only the metrics whose matched segment is accepted by filter are computed.
+func (h *MackerelPlugin) computeValuesWithWildcard(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues, filter func(segment string) bool) map[string]wildcardValue {
+	re := wildcardRegexp(prefix, metric)
+	values := make(map[string]wildcardValue)
+	matched := 0
 	for k := range metricValues.Values {
-		if re.MatchString(k) {
-			metricEach := metric
-			metricEach.Name = k
-			h.formatValues("", metricEach, metricValues, lastMetricValues)
+		m := re.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		matched++
+		segment := strings.Join(m[1:], ".")
+		if filter != nil && !filter(segment) {
+			h.explain(h.metricKey("", k)).drop("filtered out by Include or Exclude")
+			continue
+		}
+		metricEach := metric
+		metricEach.Name = k
+		ex := h.explain(h.metricKey("", k))
+		if v, ok := h.computeValue("", metricEach, metricValues, lastMetricValues, ex); ok {
+			values[k] = wildcardValue{segment: segment, value: v, ex: ex}
+		}
+	}
+	if matched == 0 {
+		h.explain(h.metricKey(prefix, metric.Name)).drop("no keys matched")
+	}
+	return values
+}
+
+// formatValuesWithWildcard prints the values of metrics matching to the wildcard,
+// and returns the computed values by their names.
+func (h *MackerelPlugin) formatValuesWithWildcard(prefix string, metric Metrics, metricValues MetricValues, lastMetricValues MetricValues) map[string]interface{} {
+	return h.formatGraphWithWildcard(prefix, Graphs{}, []Metrics{metric}, metricValues, lastMetricValues)
+}
+
+// formatGraphWithWildcard prints the values of metrics, which contain the wildcard, in graph.
+// The series are filtered by graph.Include and graph.Exclude, and limited up to graph.MaxSeries.
+// It returns the computed values, including aggregated ones, by their names.
+func (h *MackerelPlugin) formatGraphWithWildcard(key string, graph Graphs, metrics []Metrics, metricValues MetricValues, lastMetricValues MetricValues) map[string]interface{} {
+	filter := seriesFilter(graph.Include, graph.Exclude)
+	series := make([]map[string]wildcardValue, len(metrics))
+	for i, metric := range metrics {
+		series[i] = h.computeValuesWithWildcard(key, metric, metricValues, lastMetricValues, filter)
+	}
+	kept := selectSeries(key, graph, series)
+
+	computed := make(map[string]interface{})
+	for i, metric := range metrics {
+		values := make(map[string]interface{})
+		for k, v := range series[i] {
+			values[k] = v.value
+		}
+		for _, k := range sortedKeys(values) {
+			computed[k] = values[k]
+			if kept == nil || kept[series[i][k].segment] {
+				series[i][k].ex.output(values[k])
+				h.outputValue(h.metricKey("", k), values[k], metricValues.timestampOf(k))
+			} else {
+				series[i][k].ex.drop("exceeded MaxSeries")
+			}
+		}
+		// Aggregates are not affected by MaxSeries, so that they represent all series.
+		aggregates := append(append([]Aggregate{}, graph.Aggregates...), metric.Aggregates...)
+		for k, v := range h.formatAggregatedValues(key, metric, aggregates, values, metricValues.Values, metricValues.Timestamp) {
+			computed[k] = v
+		}
+	}
+	return computed
+}
+
+func seriesFilter(include, exclude []string) func(segment string) bool {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	compile := func(patterns []string) []*regexp.Regexp {
+		res := make([]*regexp.Regexp, 0, len(patterns))
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				log.Fatalln("Failed to compile regexp: ", err)
+			}
+			res = append(res, re)
+		}
+		return res
+	}
+	includes := compile(include)
+	excludes := compile(exclude)
+	return func(segment string) bool {
+		if len(includes) > 0 {
+			matched := false
+			for _, re := range includes {
+				if re.MatchString(segment) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+		for _, re := range excludes {
+			if re.MatchString(segment) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// selectSeries returns the set of segments to output if the number of series exceeds graph.MaxSeries.
+// It returns nil if all series can be output.
+func selectSeries(key string, graph Graphs, series []map[string]wildcardValue) map[string]bool {
+	if graph.MaxSeries <= 0 {
+		return nil
+	}
+	totals := make(map[string]float64)
+	for _, values := range series {
+		for _, v := range values {
+			totals[v.segment] += toFloat64(v.value)
+		}
+	}
+	if len(totals) <= graph.MaxSeries {
+		return nil
+	}
+	segments := make([]string, 0, len(totals))
+	for segment := range totals {
+		segments = append(segments, segment)
+	}
+	switch graph.SeriesOrder {
+	case SeriesOrderValue:
+		sort.Slice(segments, func(i, j int) bool {
+			a, b := totals[segments[i]], totals[segments[j]]
+			if a != b {
+				return a > b
+			}
+			return segments[i] < segments[j]
+		})
+	default:
+		sort.Strings(segments)
+	}
+	log.Printf("%s: the number of series (%d) exceeds MaxSeries; only %d series are output\n", key, len(segments), graph.MaxSeries)
+	kept := make(map[string]bool)
+	for _, segment := range segments[:graph.MaxSeries] {
+		kept[segment] = true
+	}
+	return kept
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatAggregatedValues prints the series aggregated over values, which are the result of formatValuesWithWildcard,
+// and returns the printed values by their names.
+// An aggregated series whose name is the same as a series in values or fetched is not printed, not to overwrite it.
+func (h *MackerelPlugin) formatAggregatedValues(prefix string, metric Metrics, aggregates []Aggregate, values map[string]interface{}, fetched map[string]interface{}, now time.Time) map[string]interface{} {
+	if len(aggregates) == 0 {
+		return nil
+	}
+	keys := sortedKeys(values)
+
+	aggregated := make(map[string]interface{})
+	for _, a := range aggregates {
+		var value float64
+		switch a.Func {
+		case AggregateCount:
+			value = float64(len(keys))
+		case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+			if len(keys) == 0 {
+				continue
+			}
+			value = toFloat64(values[keys[0]])
+			for _, k := range keys[1:] {
+				v := toFloat64(values[k])
+				switch a.Func {
+				case AggregateSum, AggregateAvg:
+					value += v
+				case AggregateMin:
+					value = math.Min(value, v)
+				case AggregateMax:
+					value = math.Max(value, v)
+				}
+			}
+			if a.Func == AggregateAvg {
+				value /= float64(len(keys))
+			}
+		default:
+			log.Printf("Unknown aggregate function: %s\n", a.Func)
+			continue
+		}
+		key := aggregateKey(prefix, metric, a)
+		ex := h.explain(h.metricKey("", key))
+		_, inValues := values[key]
+		_, inFetched := fetched[key]
+		if inValues || inFetched {
+			log.Printf("Aggregated series %s collides with a series matched by the wildcard, so it is not output\n", h.metricKey("", key))
+			ex.drop(fmt.Sprintf("%s of %d values collides with a series matched by the wildcard", a.Func, len(keys)))
+			continue
 		}
+		ex.add("%s of %d values", a.Func, len(keys))
+		ex.output(value)
+		if h.aggregated != nil {
+			h.aggregated[h.metricKey("", key)] = true
+		}
+		h.outputValue(h.metricKey("", key), value, now)
+		aggregated[key] = value
+	}
+	return aggregated
+}
+
+// aggregateKey returns the key of the series of metric aggregated by a, without the metric key prefix.
+func aggregateKey(prefix string, metric Metrics, a Aggregate) string {
+	pattern := metric.Name
+	if len(prefix) > 0 {
+		pattern = prefix + "." + metric.Name
+	}
+	name := a.Name
+	if name == "" {
+		name = a.Func
 	}
+	return strings.NewReplacer("*", name, "#", name).Replace(pattern)
 }
 
 // Run the plugin
 func (h *MackerelPlugin) Run() {
-	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
+	if h.meta || os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
 		h.OutputDefinitions()
 	} else {
 		h.OutputValues()
@@ -367,35 +1150,197 @@ func (h *MackerelPlugin) Run() {
 
 // OutputValues output the metrics
 func (h *MackerelPlugin) OutputValues() {
-	stat, err := h.FetchMetrics()
+	err := h.collectValues(h.valuePrinter(os.Stdout))
 	if err != nil {
+		if err == errStateUpdated {
+			log.Println("OutputValues: ", err)
+			return
+		}
 		log.Fatalln("OutputValues: ", err)
 	}
-	metricValues := MetricValues{Values: stat, Timestamp: time.Now()}
+}
+
+// warnUnknownTypes logs the metrics whose Type is unknown, which are regarded as Float64.
+func (h *MackerelPlugin) warnUnknownTypes() {
+	var warnings []string
+	for key, graph := range h.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			if !metric.Type.valid() {
+				warnings = append(warnings, fmt.Sprintf("%s: unknown type %q is regarded as %q", h.metricKey(key, metric.Name), metric.Type, Float64))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	for _, w := range warnings {
+		log.Println("OutputValues:", w)
+	}
+}
+
+// fetchMetrics calls h.FetchMetrics within h.Timeout.
+func (h *MackerelPlugin) fetchMetrics() (map[string]interface{}, error) {
+	if h.Timeout <= 0 {
+		return h.FetchMetrics()
+	}
+	type result struct {
+		stat map[string]interface{}
+		err  error
+	}
+	ch := make(chan result, 1)
+	p := h.Plugin
+	go func() {
+		stat, err := p.FetchMetrics()
+		ch <- result{stat, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.stat, r.err
+	case <-time.After(h.Timeout):
+		return nil, fmt.Errorf("FetchMetrics timed out after %v", h.Timeout)
+	}
+}
+
+// valuePrinter returns the function to print values to w in h.Format.
+func (h *MackerelPlugin) valuePrinter(w io.Writer) func(key string, value interface{}, now time.Time) {
+	printValue := h.printValue
+	if h.Format == FormatJSON {
+		printValue = h.printJSONValue
+	}
+	return func(key string, value interface{}, now time.Time) {
+		printValue(w, key, value, now)
+	}
+}
+
+// now returns the current time of h.Clock.
+func (h *MackerelPlugin) now() time.Time {
+	if h.Clock == nil {
+		return time.Now()
+	}
+	return h.Clock.Now()
+}
+
+// CollectValues fetches the metrics and passes each computed value to output instead of printing it,
+// then saves the values to calculate differentials at the next time.
+func (h *MackerelPlugin) CollectValues(output func(key string, value interface{}, now time.Time)) error {
+	return h.collectValues(output)
+}
+
+// collectValues fetches the metrics and passes each computed value to output,
+// then saves the values to calculate differentials at the next time.
+func (h *MackerelPlugin) collectValues(output func(key string, value interface{}, now time.Time)) error {
+	h.output = output
+	defer func() { h.output = nil }()
+	if h.SelfMetrics {
+		h.stats = &selfStats{}
+		defer func() { h.stats = nil }()
+	}
+
+	// The duration is measured with the monotonic clock rather than Clock, which may be replaced.
+	// The time of the fetch is taken once, so that RecordPlugin records the same time as the timestamp.
+	now := h.now()
+	if p, ok := h.Plugin.(fetchTimedPlugin); ok {
+		p.setFetchTime(now)
+	}
+	start := time.Now()
+	stat, err := h.fetchMetrics()
+	if h.stats != nil {
+		h.stats.fetchDuration = time.Since(start)
+		h.stats.fetchedKeys = len(stat)
+	}
+	fetchErrors := 0
+	if err != nil {
+		n, ok := partialFailures(err)
+		if !ok || len(stat) == 0 {
+			return err
+		}
+		log.Println("FetchMetrics:", err)
+		fetchErrors = n
+	}
+	metricValues := MetricValues{Values: stat, Timestamp: now}
+	if p, ok := h.Plugin.(timestampedPlugin); ok {
+		metricValues.LastSeen = p.timestamps()
+	}
 
 	lastMetricValues, err := h.fetchLastValuesSafe(metricValues.Timestamp)
 	if err != nil {
 		if err == errStateUpdated {
-			log.Println("OutputValues: ", err)
-			return
+			return err
 		}
 		log.Println("FetchLastValues (ignore):", err)
 	}
 
+	h.warnUnknownTypes()
+
+	computed := make(map[string]interface{})
+	type derivedMetric struct {
+		key    string
+		metric Metrics
+	}
+	var derived []derivedMetric
 	for key, graph := range h.GraphDefinition() {
+		var wildcardMetrics []Metrics
 		for _, metric := range graph.Metrics {
+			if metric.Expr != "" {
+				derived = append(derived, derivedMetric{key: key, metric: metric})
+				continue
+			}
 			if strings.ContainsAny(key+metric.Name, "*#") {
-				h.formatValuesWithWildcard(key, metric, metricValues, lastMetricValues)
-			} else {
-				h.formatValues(key, metric, metricValues, lastMetricValues)
+				wildcardMetrics = append(wildcardMetrics, metric)
+				continue
+			}
+			if v, ok := h.formatValues(key, metric, metricValues, lastMetricValues); ok {
+				computed[valueName(key, metric)] = v
+			}
+		}
+		if len(wildcardMetrics) > 0 {
+			for k, v := range h.formatGraphWithWildcard(key, graph, wildcardMetrics, metricValues, lastMetricValues) {
+				computed[k] = v
+			}
+		}
+	}
+	// Derived metrics are evaluated after all other metrics are diffed and scaled,
+	// and after the derived metrics which they refer to.
+	defined := h.metricMatcher(func(Metrics) bool { return true })
+	pending := make(map[string]bool)
+	for _, d := range derived {
+		pending[valueName(d.key, d.metric)] = true
+	}
+	for len(derived) > 0 {
+		var rest []derivedMetric
+		for _, d := range derived {
+			if refersToAny(d.metric.Expr, pending) {
+				rest = append(rest, d)
+				continue
+			}
+			name := valueName(d.key, d.metric)
+			if v, ok := h.formatDerivedValues(d.key, d.metric, metricValues, computed, defined); ok {
+				computed[name] = v
 			}
+			delete(pending, name)
 		}
+		if len(rest) == len(derived) {
+			for _, d := range rest {
+				log.Printf("Failed to evaluate the expression of %s: circular reference\n", d.metric.Name)
+				h.explain(h.metricKey(d.key, d.metric.Name)).drop("circular reference")
+			}
+			break
+		}
+		derived = rest
+	}
+
+	if h.ReportFetchErrors {
+		h.outputValue(h.metricKey(fetchGraphKey, "errors"), float64(fetchErrors), metricValues.Timestamp)
+	}
+	if h.StateTTL > 0 && h.hasDiff() {
+		expired := h.carryOverValues(&metricValues, lastMetricValues)
+		h.outputValue(h.metricKey(stateGraphKey, "expired_keys"), float64(expired), metricValues.Timestamp)
 	}
 
 	err = h.saveValues(metricValues)
 	if err != nil {
-		log.Fatalln("saveValues: ", err)
+		return fmt.Errorf("saveValues: %w", err)
 	}
+	h.outputSelfMetrics(metricValues.Timestamp)
+	return nil
 }
 
 // GraphDef represents graph definitions
@@ -408,15 +1353,69 @@ func title(s string) string {
 	return cases.Title(language.Und, cases.NoLower).String(r.Replace(s))
 }
 
+const (
+	stateGraphKey = "plugin_helper.state"
+	fetchGraphKey = "plugin_helper.fetch"
+)
+
+// helperGraphDefinition returns the definitions of the graphs which the helper outputs by itself.
+func (h *MackerelPlugin) helperGraphDefinition() map[string]Graphs {
+	graphs := make(map[string]Graphs)
+	if h.SelfMetrics {
+		for key, graph := range h.selfGraphDefinition() {
+			graphs[key] = graph
+		}
+	}
+	if h.ReportFetchErrors {
+		graphs[fetchGraphKey] = Graphs{
+			Label: "Plugin Fetch",
+			Unit:  "integer",
+			Metrics: []Metrics{
+				{Name: "errors", Label: "Errors"},
+			},
+		}
+	}
+	if h.StateTTL > 0 && h.hasDiff() {
+		graphs[stateGraphKey] = Graphs{
+			Label: "Plugin State",
+			Unit:  "integer",
+			Metrics: []Metrics{
+				{Name: "expired_keys", Label: "Expired Keys"},
+			},
+		}
+	}
+	return graphs
+}
+
 // OutputDefinitions outputs graph definitions
 func (h *MackerelPlugin) OutputDefinitions() {
 	fmt.Println("# mackerel-agent-plugin")
+	var graphdef GraphDef
+	graphdef.Graphs = h.outputGraphDefinition()
+	b, err := json.Marshal(graphdef)
+	if err != nil {
+		log.Fatalln("OutputDefinitions: ", err)
+	}
+	fmt.Println(string(b))
+}
+
+// FullGraphDefinition returns the graph definitions which OutputDefinitions outputs.
+// Their keys include the prefix, and they include the graphs which the helper outputs by itself.
+func (h *MackerelPlugin) FullGraphDefinition() map[string]Graphs {
+	return h.outputGraphDefinition()
+}
+
+// outputGraphDefinition returns the graph definitions to output, whose keys include the prefix.
+func (h *MackerelPlugin) outputGraphDefinition() map[string]Graphs {
 	graphs := make(map[string]Graphs)
+	defs := h.helperGraphDefinition()
 	for key, graph := range h.GraphDefinition() {
+		defs[key] = graph
+	}
+	for key, graph := range defs {
 		g := graph
 		k := key
-		if p, ok := h.Plugin.(PluginWithPrefix); ok {
-			prefix := p.MetricKeyPrefix()
+		if prefix, ok := h.metricKeyPrefix(); ok {
 			if k == "" {
 				k = prefix
 			} else {
@@ -426,6 +1425,10 @@ func (h *MackerelPlugin) OutputDefinitions() {
 		if g.Label == "" {
 			g.Label = title(k)
 		}
+		if !g.Unit.valid() {
+			log.Printf("OutputDefinitions: %s: unknown unit %q is replaced with %q\n", k, g.Unit, UnitFloat)
+			g.Unit = UnitFloat
+		}
 		metrics := []Metrics{}
 		for _, v := range g.Metrics {
 			if v.Label == "" {
@@ -436,13 +1439,19 @@ func (h *MackerelPlugin) OutputDefinitions() {
 		g.Metrics = metrics
 		graphs[k] = g
 	}
-	var graphdef GraphDef
-	graphdef.Graphs = graphs
-	b, err := json.Marshal(graphdef)
-	if err != nil {
-		log.Fatalln("OutputDefinitions: ", err)
+	return graphs
+}
+
+// zeroValue returns 0 of typ.
+func zeroValue(typ MetricType) interface{} {
+	switch typ {
+	case Uint32:
+		return uint32(0)
+	case Uint64:
+		return uint64(0)
+	default:
+		return 0.0
 	}
-	fmt.Println(string(b))
 }
 
 func toUint32(value interface{}) uint32 {
@@ -454,11 +1463,11 @@ func toUint32(value interface{}) uint32 {
 	case float64:
 		return uint32(v)
 	case string:
-		n, err := strconv.ParseUint(v, 10, 32)
+		n, err := parseNumber(v, Uint32)
 		if err != nil {
 			return 0
 		}
-		return uint32(n)
+		return n.(uint32)
 	default:
 		return 0
 	}
@@ -473,11 +1482,11 @@ func toUint64(value interface{}) uint64 {
 	case float64:
 		return uint64(v)
 	case string:
-		n, err := strconv.ParseUint(v, 10, 64)
+		n, err := parseNumber(v, Uint64)
 		if err != nil {
 			return 0
 		}
-		return n
+		return n.(uint64)
 	default:
 		return 0
 	}
@@ -492,11 +1501,11 @@ func toFloat64(value interface{}) float64 {
 	case float64:
 		return v
 	case string:
-		n, err := strconv.ParseFloat(v, 64)
+		n, err := parseNumber(v, Float64)
 		if err != nil {
 			return 0
 		}
-		return n
+		return n.(float64)
 	default:
 		return 0
 	}
@@ -46,6 +46,42 @@ func TestCalcDiffWithReset(t *testing.T) {
 	}
 }
 
+func TestCalcDiffWithoutElapsedTime(t *testing.T) {
+	var mp MackerelPlugin
+
+	now := time.Unix(1624848982, 0)
+	for _, last := range []time.Time{now, now.Add(time.Minute)} {
+		diff, err := mp.calcDiff(10.0, now, 0.0, last)
+		if err == nil {
+			t.Errorf("calcDiff from %d to %d should cause an error: %f", last.Unix(), now.Unix(), diff)
+		}
+	}
+}
+
+func TestScaleValue(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		metric Metrics
+		want   interface{}
+	}{
+		{uint32(10), Metrics{Type: Uint32}, uint32(10)},
+		{uint32(10), Metrics{Type: Uint32, Scale: 8}, uint32(80)},
+		{uint64(math.MaxUint64 / 2), Metrics{Type: Uint64, Scale: 2}, uint64(math.MaxUint64 - 1)},
+		{uint64(1500), Metrics{Type: Uint64, Scale: 0.001}, 1.5},
+		{uint32(2048), Metrics{Type: Uint32, Scale: 1.0 / 1024}, 2.0},
+		{uint64(3), Metrics{Type: Uint64, Scale: 4096, Divisor: 1024}, 12.0},
+		{300.5, Metrics{Offset: -273.5}, 27.0},
+		{10.0, Metrics{Scale: 3, Divisor: 2, Offset: 1}, 16.0},
+		// a differential of an integer type is float64
+		{2.5, Metrics{Type: Uint64, Scale: 0.5}, 1.25},
+	}
+	for _, tt := range tests {
+		if got := scaleValue(tt.value, tt.metric, nil); got != tt.want {
+			t.Errorf("scaleValue(%#v, %+v) = %#v; want %#v", tt.value, tt.metric, got, tt.want)
+		}
+	}
+}
+
 func TestCalcDiffWithUInt32WithReset(t *testing.T) {
 	var mp MackerelPlugin
 
@@ -149,6 +185,22 @@ func TestPrintValueFloat64(t *testing.T) {
 	}
 }
 
+func TestPrintJSONValue(t *testing.T) {
+	var mp MackerelPlugin
+	s := new(bytes.Buffer)
+	var now = time.Unix(1437227240, 0)
+	mp.printJSONValue(s, "test", uint64(10), now)
+	mp.printJSONValue(s, "test2", 1.5, now)
+	mp.printJSONValue(s, "test3", math.NaN(), now)
+
+	expected := []byte(`{"key":"test","value":10,"timestamp":1437227240}` + "\n" +
+		`{"key":"test2","value":1.5,"timestamp":1437227240}` + "\n")
+
+	if !bytes.Equal(expected, s.Bytes()) {
+		t.Fatalf("not matched, expected: %s, got: %s", expected, s)
+	}
+}
+
 type emptyPlugin struct {
 }
 
@@ -222,10 +274,24 @@ func TestOutput(t *testing.T) {
 		tcFormatValuesWithWildcardAndAbsoluteName,
 		tcFormatValuesWithWildcardAndNoDiff,
 		tcFormatValuesWithWildcardAstarisk,
+		tcFormatValuesWithLastSeen,
+		tcFormatValuesWithTimestampOfValue,
+		tcFormatGraphWithWildcardAndFilters,
+		tcFormatGraphWithWildcardAndMaxSeriesByName,
+		tcFormatGraphWithWildcardAndMaxSeriesByValue,
+		tcFormatAggregatedValues,
+		tcFormatAggregatedValuesWithAstariskAndNoValues,
+		tcFormatAggregatedValuesWithCollision,
+		tcFormatDerivedValues,
+		tcFormatDerivedValuesWithMissingName,
 		tcOutputDefinitions,
+		tcOutputDefinitionsWithUnknownUnit,
 		tcPluginWithPrefixOutputDefinitions,
 		tcPluginWithPrefixOutputValues,
 		tcPluginWithPrefixOutputValues2,
+		tcMetricKeyPrefixOverrideOutputDefinitions,
+		tcMetricKeyPrefixOverrideOutputValues,
+		tcMetricKeyPrefixOverrideLegacyPluginOutputDefinitions,
 	}
 
 	for _, tc := range tests {
@@ -487,6 +553,216 @@ func tcFormatValuesWithWildcardAstarisk() []string {
 	}
 }
 
+func tcFormatValuesWithLastSeen() []string {
+	var mp MackerelPlugin
+	prefix := "foo"
+	metric := Metrics{Name: "cmd_get", Label: "Get", Diff: true, Type: "uint64"}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": uint64(1000)},
+		Timestamp: now,
+	}
+	lastMetricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": uint64(500)},
+		Timestamp: now.Add(-time.Duration(60) * time.Second),
+		LastSeen:  map[string]time.Time{"cmd_get": now.Add(-time.Duration(120) * time.Second)},
+	}
+	mp.formatValues(prefix, metric, metricValues, lastMetricValues)
+
+	return []string{"foo.cmd_get	250.000000	1437227240"}
+}
+
+func tcFormatValuesWithTimestampOfValue() []string {
+	var mp MackerelPlugin
+	prefix := "foo"
+	metric := Metrics{Name: "cmd_get", Label: "Get", Diff: true, Type: "uint64"}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": uint64(1000)},
+		Timestamp: now,
+		LastSeen:  map[string]time.Time{"cmd_get": now.Add(-time.Duration(30) * time.Second)},
+	}
+	lastMetricValues := MetricValues{
+		Values:    map[string]interface{}{"cmd_get": uint64(500)},
+		Timestamp: now.Add(-time.Duration(60) * time.Second),
+	}
+	mp.formatValues(prefix, metric, metricValues, lastMetricValues)
+
+	return []string{"foo.cmd_get	1000.000000	1437227210"}
+}
+
+func tcFormatGraphWithWildcardAndFilters() []string {
+	var mp MackerelPlugin
+	key := "disk.#"
+	graph := Graphs{
+		Include: []string{`^sd`, `^nvme`},
+		Exclude: []string{`^sdz$`},
+	}
+	metrics := []Metrics{{Name: "reads"}}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values: map[string]interface{}{
+			"disk.sda.reads":   10.0,
+			"disk.sdz.reads":   20.0,
+			"disk.nvme0.reads": 30.0,
+			"disk.loop0.reads": 40.0,
+		},
+		Timestamp: now,
+	}
+	mp.formatGraphWithWildcard(key, graph, metrics, metricValues, MetricValues{})
+
+	return []string{
+		"disk.nvme0.reads	30.000000	1437227240",
+		"disk.sda.reads	10.000000	1437227240",
+	}
+}
+
+func tcFormatGraphWithWildcardAndMaxSeriesByName() []string {
+	var mp MackerelPlugin
+	key := "disk.#"
+	graph := Graphs{
+		MaxSeries:  2,
+		Aggregates: []Aggregate{{Func: AggregateCount}},
+	}
+	metrics := []Metrics{{Name: "reads"}, {Name: "writes"}}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values: map[string]interface{}{
+			"disk.sdc.reads":  10.0,
+			"disk.sdb.reads":  20.0,
+			"disk.sda.reads":  30.0,
+			"disk.sdc.writes": 1.0,
+		},
+		Timestamp: now,
+	}
+	mp.formatGraphWithWildcard(key, graph, metrics, metricValues, MetricValues{})
+
+	return []string{
+		"disk.sda.reads	30.000000	1437227240",
+		"disk.sdb.reads	20.000000	1437227240",
+		"disk.count.reads	3.000000	1437227240",
+		"disk.count.writes	1.000000	1437227240",
+	}
+}
+
+func tcFormatGraphWithWildcardAndMaxSeriesByValue() []string {
+	var mp MackerelPlugin
+	key := "disk.#"
+	graph := Graphs{
+		MaxSeries:   2,
+		SeriesOrder: SeriesOrderValue,
+	}
+	metrics := []Metrics{{Name: "reads"}, {Name: "writes"}}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values: map[string]interface{}{
+			"disk.sda.reads":  10.0,
+			"disk.sdb.reads":  20.0,
+			"disk.sdc.reads":  15.0,
+			"disk.sda.writes": 30.0,
+		},
+		Timestamp: now,
+	}
+	mp.formatGraphWithWildcard(key, graph, metrics, metricValues, MetricValues{})
+
+	return []string{
+		"disk.sda.reads	10.000000	1437227240",
+		"disk.sdb.reads	20.000000	1437227240",
+		"disk.sda.writes	30.000000	1437227240",
+	}
+}
+
+func tcFormatAggregatedValues() []string {
+	var mp MackerelPlugin
+	prefix := "foo.#"
+	metric := Metrics{Name: "bar", Label: "Get", Diff: true, Type: "uint64"}
+	aggregates := []Aggregate{
+		{Func: AggregateSum},
+		{Func: AggregateAvg, Name: "average"},
+		{Func: AggregateMin},
+		{Func: AggregateMax},
+		{Func: AggregateCount},
+	}
+	now := time.Unix(1437227240, 0)
+	values := map[string]interface{}{"foo.1.bar": 500.0, "foo.2.bar": 300.0, "foo.3.bar": 100.0}
+	mp.formatAggregatedValues(prefix, metric, aggregates, values, nil, now)
+
+	return []string{
+		"foo.sum.bar	900.000000	1437227240",
+		"foo.average.bar	300.000000	1437227240",
+		"foo.min.bar	100.000000	1437227240",
+		"foo.max.bar	500.000000	1437227240",
+		"foo.count.bar	3.000000	1437227240",
+	}
+}
+
+func tcFormatAggregatedValuesWithCollision() []string {
+	var mp MackerelPlugin
+	prefix := "foo.#"
+	metric := Metrics{Name: "bar"}
+	aggregates := []Aggregate{
+		{Func: AggregateSum, Name: "total"},
+		{Func: AggregateMax, Name: "peak"},
+		{Func: AggregateCount},
+	}
+	now := time.Unix(1437227240, 0)
+	values := map[string]interface{}{"foo.1.bar": 500.0, "foo.total.bar": 300.0}
+	// foo.peak.bar is fetched but not computed, such as a counter at the first run.
+	fetched := map[string]interface{}{"foo.1.bar": "500", "foo.total.bar": "300", "foo.peak.bar": "100"}
+	mp.formatAggregatedValues(prefix, metric, aggregates, values, fetched, now)
+
+	return []string{
+		"foo.count.bar	2.000000	1437227240",
+	}
+}
+
+func tcFormatAggregatedValuesWithAstariskAndNoValues() []string {
+	var mp MackerelPlugin
+	prefix := "foo"
+	metric := Metrics{Name: "*", Label: "Get"}
+	aggregates := []Aggregate{
+		{Func: AggregateSum, Name: "total"},
+		{Func: AggregateCount},
+	}
+	now := time.Unix(1437227240, 0)
+	mp.formatAggregatedValues(prefix, metric, aggregates, nil, nil, now)
+
+	return []string{
+		"foo.count	0.000000	1437227240",
+	}
+}
+
+func tcFormatDerivedValues() []string {
+	var mp MackerelPlugin
+	prefix := "foo"
+	metric := Metrics{Name: "hit_rate", Label: "Hit Rate", Expr: "get_hits / (get_hits + get_misses) * 100"}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"get_hits": "1000", "get_misses": "500"},
+		Timestamp: now,
+	}
+	computed := map[string]interface{}{"get_hits": 300.0}
+	mp.formatDerivedValues(prefix, metric, metricValues, computed, nil)
+
+	return []string{
+		"foo.hit_rate	37.500000	1437227240",
+	}
+}
+
+func tcFormatDerivedValuesWithMissingName() []string {
+	var mp MackerelPlugin
+	prefix := "foo"
+	metric := Metrics{Name: "hit_rate", Label: "Hit Rate", Expr: "get_hits / (get_hits + get_misses)"}
+	now := time.Unix(1437227240, 0)
+	metricValues := MetricValues{
+		Values:    map[string]interface{}{"get_hits": uint64(1000)},
+		Timestamp: now,
+	}
+	mp.formatDerivedValues(prefix, metric, metricValues, nil, nil)
+
+	return nil
+}
+
 // an example implementation
 type MemcachedPlugin struct {
 }
@@ -521,6 +797,43 @@ func tcOutputDefinitions() []string {
 	}
 }
 
+type testPUnknown struct{}
+
+func (t testPUnknown) FetchMetrics() (map[string]interface{}, error) {
+	return map[string]interface{}{"foo": "1.5"}, nil
+}
+
+func (t testPUnknown) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"unknown": {
+			Unit: "integr",
+			Metrics: []Metrics{
+				{Name: "foo", Type: "uint46"},
+			},
+		},
+	}
+}
+
+func tcOutputDefinitionsWithUnknownUnit() []string {
+	helper := NewMackerelPlugin(testPUnknown{})
+	helper.OutputDefinitions()
+
+	return []string{
+		"# mackerel-agent-plugin",
+		`{"graphs":{"unknown":{"label":"Unknown","unit":"float","metrics":[{"name":"foo","label":"Foo","stacked":false}]}}}`,
+	}
+}
+
+func TestWarnUnknownTypes(t *testing.T) {
+	buf := captureLog(t)
+	helper := NewMackerelPlugin(testPUnknown{})
+	helper.warnUnknownTypes()
+	want := `OutputValues: unknown.foo: unknown type "uint46" is regarded as "float64"` + "\n"
+	if buf.String() != want {
+		t.Errorf("warnUnknownTypes: got %q; want %q", buf.String(), want)
+	}
+}
+
 func TestToUint32(t *testing.T) {
 	if ret := toUint32(uint32(100)); ret != uint32(100) {
 		t.Errorf("toUint32(uint32) returns incorrect value: %v expected to be %v", ret, uint32(100))
@@ -770,8 +1083,34 @@ func TestPluginHasDiff(t *testing.T) {
 	}
 }
 
+type testPState struct{}
+
+func (t testPState) FetchMetrics() (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func (t testPState) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"": {
+			Metrics: []Metrics{
+				{Name: "key1", Diff: true},
+				{Name: "key2", Diff: true},
+				{Name: "key3", Diff: true},
+				{Name: "key4", Diff: true},
+				{Name: "gauge"},
+			},
+		},
+		"foo.#": {
+			Metrics: []Metrics{
+				{Name: "bar", Diff: true, Type: "uint64"},
+				{Name: "baz"},
+			},
+		},
+	}
+}
+
 func TestSaveStateIfContainsInvalidNumbers(t *testing.T) {
-	p := NewMackerelPlugin(testPHasDiff{})
+	p := NewMackerelPlugin(testPState{})
 	f := createTempState(t)
 	defer f.Close()
 	p.Tempfile = f.Name()
@@ -821,3 +1160,220 @@ func createTempState(t testing.TB) *os.File {
 	})
 	return f
 }
+
+func TestCarryOverValues(t *testing.T) {
+	p := NewMackerelPlugin(testPHasDiff{})
+	p.StateTTL = 10 * time.Minute
+	now := time.Unix(1624848982, 0)
+	last := MetricValues{
+		Values: map[string]interface{}{
+			"_lastTime":            float64(now.Add(-time.Minute).Unix()),
+			"foo.1.bar":            100.0,
+			"foo.2.bar":            200.0,
+			".last_diff.foo.2.bar": 2.0,
+			"foo.3.bar":            300.0,
+		},
+		Timestamp: now.Add(-time.Minute),
+		LastSeen: map[string]time.Time{
+			"foo.2.bar":            now.Add(-5 * time.Minute),
+			".last_diff.foo.2.bar": now.Add(-5 * time.Minute),
+			"foo.3.bar":            now.Add(-time.Hour),
+		},
+	}
+	values := MetricValues{
+		Values:    map[string]interface{}{"foo.1.bar": 150.0},
+		Timestamp: now,
+	}
+	expired := p.carryOverValues(&values, last)
+	if expired != 1 {
+		t.Errorf("carryOverValues() = %d; want 1", expired)
+	}
+	want := MetricValues{
+		Values: map[string]interface{}{
+			"foo.1.bar":            150.0,
+			"foo.2.bar":            200.0,
+			".last_diff.foo.2.bar": 2.0,
+		},
+		Timestamp: now,
+		LastSeen: map[string]time.Time{
+			"foo.2.bar":            now.Add(-5 * time.Minute),
+			".last_diff.foo.2.bar": now.Add(-5 * time.Minute),
+		},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("carryOverValues: got %v; want %v", values, want)
+	}
+}
+
+func TestSaveAndFetchLastSeen(t *testing.T) {
+	p := NewMackerelPlugin(testPState{})
+	f := createTempState(t)
+	defer f.Close()
+	p.Tempfile = f.Name()
+
+	now := time.Unix(1624848982, 0)
+	values := MetricValues{
+		Values:    map[string]interface{}{"key1": 3.0, "key2": 4.0},
+		Timestamp: now,
+		LastSeen:  map[string]time.Time{"key2": now.Add(-time.Minute)},
+	}
+	if err := p.saveValues(values); err != nil {
+		t.Fatalf("saveValues: %v", err)
+	}
+	last, err := p.FetchLastValues()
+	if err != nil {
+		t.Fatal("FetchLastValues:", err)
+	}
+	if got := last.timestampOf("key1"); !got.Equal(now) {
+		t.Errorf("timestampOf(key1) = %v; want %v", got, now)
+	}
+	if got := last.timestampOf("key2"); !got.Equal(now.Add(-time.Minute)) {
+		t.Errorf("timestampOf(key2) = %v; want %v", got, now.Add(-time.Minute))
+	}
+}
+
+func TestSaveAndFetchLargeUint64(t *testing.T) {
+	p := NewMackerelPlugin(testPState{})
+	f := createTempState(t)
+	defer f.Close()
+	p.Tempfile = f.Name()
+
+	values := MetricValues{
+		Values:    map[string]interface{}{"key1": uint64(math.MaxUint64 - 1), "key2": 4.5},
+		Timestamp: time.Unix(1624848982, 0),
+	}
+	if err := p.saveValues(values); err != nil {
+		t.Fatalf("saveValues: %v", err)
+	}
+	last, err := p.FetchLastValues()
+	if err != nil {
+		t.Fatal("FetchLastValues:", err)
+	}
+	if v := last.Values["key1"]; v != uint64(math.MaxUint64-1) {
+		t.Errorf("key1 = %#v; want %d", v, uint64(math.MaxUint64-1))
+	}
+	if v := last.Values["key2"]; v != 4.5 {
+		t.Errorf("key2 = %#v; want 4.5", v)
+	}
+}
+
+func TestSaveValuesOnlyForDiff(t *testing.T) {
+	p := NewMackerelPlugin(testPState{})
+	f := createTempState(t)
+	defer f.Close()
+	p.Tempfile = f.Name()
+
+	const lastTime = 1624848982
+	values := MetricValues{
+		Values: map[string]interface{}{
+			"key1":                 3.0,
+			".last_diff.key1":      1.0,
+			"gauge":                5.0,
+			"foo.1.bar":            "100",
+			".last_diff.foo.1.bar": 2.0,
+			"foo.1.baz":            "blob",
+			"unknown":              6.0,
+		},
+		Timestamp: time.Unix(lastTime, 0),
+	}
+	if err := p.saveValues(values); err != nil {
+		t.Fatalf("saveValues: %v", err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":2,"lastTime":1624848982,"values":{".last_diff.foo.1.bar":2,".last_diff.key1":1,"foo.1.bar":"100","key1":3}}` + "\n"
+	if string(b) != want {
+		t.Errorf("saveValues: got %s; want %s", b, want)
+	}
+}
+
+func TestFetchLastValuesFromLegacyState(t *testing.T) {
+	p := NewMackerelPlugin(testPState{})
+	f := createTempState(t)
+	p.Tempfile = f.Name()
+	fmt.Fprintln(f, `{"_lastTime":1624848982,"key1":3,"gauge":5}`)
+	f.Close()
+
+	values, err := p.FetchLastValues()
+	if err != nil {
+		t.Fatal("FetchLastValues:", err)
+	}
+	want := MetricValues{
+		Values: map[string]interface{}{
+			"_lastTime": float64(1624848982),
+			"key1":      3.0,
+			"gauge":     5.0,
+		},
+		Timestamp: time.Unix(1624848982, 0),
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("FetchLastValues: got %v; want %v", values, want)
+	}
+
+	// the legacy state is rewritten in the current version
+	if err := p.saveValues(values); err != nil {
+		t.Fatalf("saveValues: %v", err)
+	}
+	values, err = p.FetchLastValues()
+	if err != nil {
+		t.Fatal("FetchLastValues:", err)
+	}
+	want.Values = map[string]interface{}{
+		"_lastTime": float64(1624848982),
+		"key1":      3.0,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("FetchLastValues: got %v; want %v", values, want)
+	}
+}
+
+func tcMetricKeyPrefixOverrideOutputDefinitions() []string {
+	helper := NewMackerelPlugin(testP{})
+	helper.MetricKeyPrefix = "testP2"
+	helper.OutputDefinitions()
+
+	return []string{
+		"# mackerel-agent-plugin",
+		`{"graphs":{"testP2":{"label":"TestP2","unit":"integer","metrics":[{"name":"bar","label":"Bar","stacked":false}]},"testP2.fuga":{"label":"TestP2 Fuga","unit":"float","metrics":[{"name":"baz","label":"Baz","stacked":false}]}}}`,
+	}
+}
+
+func tcMetricKeyPrefixOverrideOutputValues() []string {
+	helper := NewMackerelPlugin(testP{})
+	helper.MetricKeyPrefix = "testP2"
+	stat, _ := helper.FetchMetrics()
+	key := "fuga"
+	metric := helper.GraphDefinition()[key].Metrics[0]
+	now := time.Unix(1437227240, 0)
+	helper.formatValues(key, metric, MetricValues{Values: stat, Timestamp: now}, MetricValues{})
+
+	return []string{
+		"testP2.fuga.baz	18.000000	1437227240",
+	}
+}
+
+func tcMetricKeyPrefixOverrideLegacyPluginOutputDefinitions() []string {
+	helper := NewMackerelPlugin(MemcachedPlugin{})
+	helper.MetricKeyPrefix = "mc2"
+	helper.OutputDefinitions()
+
+	return []string{
+		"# mackerel-agent-plugin",
+		`{"graphs":{"mc2.memcached.cmd":{"label":"Memcached Command","unit":"integer","metrics":[{"name":"cmd_get","label":"Get","stacked":false}]}}}`,
+	}
+}
+
+func TestTempfilenameWithMetricKeyPrefix(t *testing.T) {
+	wd, _ := os.Getwd()
+	for _, p := range []Plugin{testP{}, MemcachedPlugin{}} {
+		h := NewMackerelPlugin(p)
+		h.MetricKeyPrefix = "override"
+		expect := filepath.Join(os.TempDir(), "mackerel-plugin-override-da39a3ee5e6b4b0d3255bfef95601890afd80709")
+		filename := h.generateTempfilePath([]string{filepath.Join(wd, "foo")})
+		if filename != expect {
+			t.Errorf("generateTempfilePath() should be %s, but: %s", expect, filename)
+		}
+	}
+}
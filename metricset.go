@@ -0,0 +1,214 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrTypeMismatch is returned by the setters of MetricSet when the value does not match Type of the metric.
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// MetricSet is a typed collection of metric values.
+// Each setter checks the value against Type of the metric in the graph definitions,
+// and stores it in the type which the helper uses for the metric.
+// A value of a metric which is not defined in the graph definitions, which may be used by Expr, is stored as is.
+type MetricSet struct {
+	names      map[string]Metrics
+	patterns   []metricSetPattern
+	values     map[string]interface{}
+	timestamps map[string]time.Time
+}
+
+type metricSetPattern struct {
+	re     *regexp.Regexp
+	metric Metrics
+}
+
+// NewMetricSet returns a new MetricSet for the metrics in graphs.
+func NewMetricSet(graphs map[string]Graphs) *MetricSet {
+	s := &MetricSet{
+		names:  make(map[string]Metrics),
+		values: make(map[string]interface{}),
+	}
+	for key, graph := range graphs {
+		for _, metric := range graph.Metrics {
+			if metric.Expr != "" {
+				continue
+			}
+			if strings.ContainsAny(key+metric.Name, "*#") {
+				s.patterns = append(s.patterns, metricSetPattern{re: wildcardRegexp(key, metric), metric: metric})
+			} else {
+				s.names[valueName(key, metric)] = metric
+			}
+		}
+	}
+	return s
+}
+
+// metricType returns Type of the metric of key, and whether the metric is defined.
+func (s *MetricSet) metricType(key string) (MetricType, bool) {
+	m, ok := s.metric(key)
+	return m.Type, ok
+}
+
+// metric returns the definition of the metric of key, and whether the metric is defined.
+func (s *MetricSet) metric(key string) (Metrics, bool) {
+	if m, ok := s.names[key]; ok {
+		return m, true
+	}
+	for _, p := range s.patterns {
+		if p.re.MatchString(key) {
+			return p.metric, true
+		}
+	}
+	return Metrics{}, false
+}
+
+func (s *MetricSet) mismatch(key string, v interface{}, typ MetricType) error {
+	return fmt.Errorf("%s: cannot set %v (%T) to the metric of type %q: %w", key, v, v, typ, ErrTypeMismatch)
+}
+
+// SetUint64 sets v to the metric of key.
+func (s *MetricSet) SetUint64(key string, v uint64) error {
+	typ, ok := s.metricType(key)
+	if !ok {
+		s.values[key] = v
+		return nil
+	}
+	switch typ {
+	case Uint32:
+		if v > math.MaxUint32 {
+			return s.mismatch(key, v, typ)
+		}
+		s.values[key] = uint32(v)
+	case Uint64:
+		s.values[key] = v
+	default:
+		s.values[key] = float64(v)
+	}
+	return nil
+}
+
+// SetInt64 sets v to the metric of key.
+func (s *MetricSet) SetInt64(key string, v int64) error {
+	typ, ok := s.metricType(key)
+	if !ok {
+		s.values[key] = float64(v)
+		return nil
+	}
+	switch typ {
+	case Uint32, Uint64:
+		if v < 0 {
+			return s.mismatch(key, v, typ)
+		}
+		return s.SetUint64(key, uint64(v))
+	default:
+		s.values[key] = float64(v)
+	}
+	return nil
+}
+
+// SetFloat64 sets v to the metric of key.
+// It returns an error if the metric is an integer type.
+func (s *MetricSet) SetFloat64(key string, v float64) error {
+	typ, ok := s.metricType(key)
+	if !ok {
+		s.values[key] = v
+		return nil
+	}
+	switch typ {
+	case Uint32, Uint64:
+		return s.mismatch(key, v, typ)
+	default:
+		s.values[key] = v
+	}
+	return nil
+}
+
+// SetString parses v in ValueFormat and Type of the metric of key, and sets it.
+// It returns an error if v cannot be parsed.
+func (s *MetricSet) SetString(key string, v string) error {
+	m, ok := s.metric(key)
+	if !ok {
+		s.values[key] = v
+		return nil
+	}
+	n, err := parseMetricValue(v, m)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, errors.Join(ErrTypeMismatch, err))
+	}
+	s.values[key] = n
+	return nil
+}
+
+// SetTime sets the time when the value of key was observed.
+// By default, the values are regarded as observed when FetchMetrics returns.
+func (s *MetricSet) SetTime(key string, t time.Time) {
+	if s.timestamps == nil {
+		s.timestamps = make(map[string]time.Time)
+	}
+	s.timestamps[key] = t
+}
+
+// Values returns the values in the form of the result of Plugin.FetchMetrics.
+func (s *MetricSet) Values() map[string]interface{} {
+	return s.values
+}
+
+// MetricSetPlugin is the interface of plugins which record metric values to MetricSet.
+type MetricSetPlugin interface {
+	FetchMetricSet(s *MetricSet) error
+	GraphDefinition() map[string]Graphs
+}
+
+// timestampedPlugin is implemented by plugins which know the time of each value.
+type timestampedPlugin interface {
+	timestamps() map[string]time.Time
+}
+
+// fetchTimedPlugin is implemented by plugins which use the time of the fetch given by the helper, such as RecordPlugin.
+type fetchTimedPlugin interface {
+	setFetchTime(now time.Time)
+}
+
+// AdaptMetricSetPlugin returns Plugin which calls p.FetchMetricSet in FetchMetrics.
+// If p implements MetricKeyPrefix, the result implements PluginWithPrefix.
+func AdaptMetricSetPlugin(p MetricSetPlugin) Plugin {
+	a := &metricSetAdapter{MetricSetPlugin: p}
+	if pp, ok := p.(interface{ MetricKeyPrefix() string }); ok {
+		return &metricSetAdapterWithPrefix{metricSetAdapter: a, prefix: pp.MetricKeyPrefix}
+	}
+	return a
+}
+
+type metricSetAdapter struct {
+	MetricSetPlugin
+	last *MetricSet
+}
+
+func (a *metricSetAdapter) FetchMetrics() (map[string]interface{}, error) {
+	s := NewMetricSet(a.GraphDefinition())
+	a.last = s
+	err := a.FetchMetricSet(s)
+	return s.Values(), err
+}
+
+func (a *metricSetAdapter) timestamps() map[string]time.Time {
+	if a.last == nil {
+		return nil
+	}
+	return a.last.timestamps
+}
+
+type metricSetAdapterWithPrefix struct {
+	*metricSetAdapter
+	prefix func() string
+}
+
+func (a *metricSetAdapterWithPrefix) MetricKeyPrefix() string {
+	return a.prefix()
+}
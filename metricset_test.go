@@ -0,0 +1,104 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var metricSetGraphs = map[string]Graphs{
+	"memcached.cmd": {
+		Metrics: []Metrics{
+			{Name: "cmd_get", Diff: true, Type: "uint64"},
+			{Name: "conns", Type: "uint32"},
+			{Name: "rusage"},
+		},
+	},
+	"disk.#": {
+		Metrics: []Metrics{
+			{Name: "reads", Diff: true, Type: "uint64"},
+		},
+	},
+}
+
+func TestMetricSet(t *testing.T) {
+	s := NewMetricSet(metricSetGraphs)
+	for _, err := range []error{
+		s.SetUint64("cmd_get", 100),
+		s.SetInt64("conns", 3),
+		s.SetString("rusage", "1.5"),
+		s.SetString("disk.sda.reads", "42"),
+		s.SetInt64("undefined", -1),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]interface{}{
+		"cmd_get":        uint64(100),
+		"conns":          uint32(3),
+		"rusage":         1.5,
+		"disk.sda.reads": uint64(42),
+		"undefined":      -1.0,
+	}
+	if got := s.Values(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Values() = %v; want %v", got, want)
+	}
+}
+
+func TestMetricSetTypeMismatch(t *testing.T) {
+	s := NewMetricSet(metricSetGraphs)
+	for _, err := range []error{
+		s.SetFloat64("cmd_get", 1.5),
+		s.SetInt64("disk.sda.reads", -1),
+		s.SetUint64("conns", math.MaxUint32+1),
+		s.SetString("conns", "1.5"),
+		s.SetString("rusage", "abc"),
+	} {
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("error should be ErrTypeMismatch: %v", err)
+		}
+	}
+	if len(s.Values()) != 0 {
+		t.Errorf("mismatched values should not be set: %v", s.Values())
+	}
+}
+
+type testMetricSetP struct {
+	now time.Time
+}
+
+func (p testMetricSetP) FetchMetricSet(s *MetricSet) error {
+	s.SetUint64("cmd_get", 100)
+	s.SetTime("cmd_get", p.now)
+	return nil
+}
+
+func (p testMetricSetP) GraphDefinition() map[string]Graphs {
+	return metricSetGraphs
+}
+
+func (p testMetricSetP) MetricKeyPrefix() string {
+	return "mc"
+}
+
+func TestAdaptMetricSetPlugin(t *testing.T) {
+	now := time.Unix(1437227240, 0)
+	p := AdaptMetricSetPlugin(testMetricSetP{now: now})
+	if pp, ok := p.(PluginWithPrefix); !ok || pp.MetricKeyPrefix() != "mc" {
+		t.Errorf("AdaptMetricSetPlugin should keep MetricKeyPrefix")
+	}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stat, map[string]interface{}{"cmd_get": uint64(100)}) {
+		t.Errorf("FetchMetrics() = %v", stat)
+	}
+	ts := p.(timestampedPlugin).timestamps()
+	if !ts["cmd_get"].Equal(now) {
+		t.Errorf("timestamps() = %v", ts)
+	}
+}
@@ -0,0 +1,137 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// MultiPlugin runs several plugins in a binary.
+// Each plugin has its own prefix, graph definitions and Tempfile.
+type MultiPlugin struct {
+	Plugins []*MackerelPlugin
+}
+
+// NewMultiPlugin returns new MultiPlugin for plugins.
+func NewMultiPlugin(plugins ...Plugin) *MultiPlugin {
+	m := &MultiPlugin{}
+	for _, p := range plugins {
+		mp := NewMackerelPlugin(p)
+		m.Plugins = append(m.Plugins, &mp)
+	}
+	return m
+}
+
+// Run the plugins
+func (m *MultiPlugin) Run() {
+	meta := os.Getenv("MACKEREL_AGENT_PLUGIN_META") != ""
+	for _, h := range m.Plugins {
+		meta = meta || h.meta
+	}
+	if meta {
+		m.OutputDefinitions()
+	} else {
+		m.OutputValues()
+	}
+}
+
+// name returns the name of the i-th plugin to be used in messages.
+func (m *MultiPlugin) name(i int) string {
+	if prefix, ok := m.Plugins[i].metricKeyPrefix(); ok {
+		return prefix
+	}
+	return "#" + strconv.Itoa(i)
+}
+
+// GraphDefinition returns the merged graph definitions of the plugins, whose keys include their prefix.
+// It returns an error if the plugins define the same graph.
+func (m *MultiPlugin) GraphDefinition() (map[string]Graphs, error) {
+	graphs := make(map[string]Graphs)
+	owners := make(map[string]int)
+	for i, h := range m.Plugins {
+		for k, g := range h.outputGraphDefinition() {
+			if j, ok := owners[k]; ok {
+				return nil, fmt.Errorf("graph %s is defined by both %s and %s", k, m.name(j), m.name(i))
+			}
+			owners[k] = i
+			graphs[k] = g
+		}
+	}
+	return graphs, nil
+}
+
+// OutputDefinitions outputs the merged graph definitions
+func (m *MultiPlugin) OutputDefinitions() {
+	graphs, err := m.GraphDefinition()
+	if err != nil {
+		log.Fatalln("OutputDefinitions: ", err)
+	}
+	b, err := json.Marshal(GraphDef{Graphs: graphs})
+	if err != nil {
+		log.Fatalln("OutputDefinitions: ", err)
+	}
+	fmt.Println("# mackerel-agent-plugin")
+	fmt.Println(string(b))
+}
+
+// OutputValues fetches the metrics of the plugins concurrently, and outputs them.
+// A failure of a plugin is logged, and does not prevent the others from outputting.
+func (m *MultiPlugin) OutputValues() {
+	m.separateTempfiles()
+
+	bufs := make([]bytes.Buffer, len(m.Plugins))
+	errs := make([]error, len(m.Plugins))
+	var wg sync.WaitGroup
+	for i, h := range m.Plugins {
+		wg.Add(1)
+		go func(i int, h *MackerelPlugin) {
+			defer wg.Done()
+			errs[i] = h.collectValues(h.valuePrinter(&bufs[i]))
+		}(i, h)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range m.Plugins {
+		os.Stdout.Write(bufs[i].Bytes())
+		if errs[i] != nil && errs[i] != errStateUpdated {
+			failed++
+		}
+		if errs[i] != nil {
+			log.Printf("OutputValues: %s: %v\n", m.name(i), errs[i])
+		}
+	}
+	if failed > 0 && failed == len(m.Plugins) {
+		log.Fatalln("OutputValues: all plugins failed")
+	}
+}
+
+// separateTempfiles makes the plugins use different Tempfiles,
+// for example plugins which do not implement PluginWithPrefix have the same default Tempfile.
+// Every plugin sharing a Tempfile is suffixed with its prefix, so that reordering the plugins
+// does not make them read the states of the others. A plugin without the prefix is suffixed with its position.
+func (m *MultiPlugin) separateTempfiles() {
+	shared := make(map[string]int)
+	for _, h := range m.Plugins {
+		shared[h.tempfilename()]++
+	}
+	used := make(map[string]bool)
+	for i, h := range m.Plugins {
+		name := h.tempfilename()
+		if shared[name] > 1 {
+			suffix := strconv.Itoa(i)
+			if prefix, ok := h.metricKeyPrefix(); ok {
+				suffix = tempfileSanitizeReg.ReplaceAllString(prefix, "_")
+			}
+			h.Tempfile = name + "-" + suffix
+			if used[h.Tempfile] || shared[h.Tempfile] > 0 {
+				h.Tempfile += "-" + strconv.Itoa(i)
+			}
+		}
+		used[h.Tempfile] = true
+	}
+}
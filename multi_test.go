@@ -0,0 +1,112 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type failingPlugin struct {
+	testP
+}
+
+func (failingPlugin) FetchMetrics() (map[string]interface{}, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingPlugin) MetricKeyPrefix() string {
+	return "failing"
+}
+
+func captureStdout(t testing.TB, f func()) string {
+	t.Helper()
+	orig := os.Stdout
+	t.Cleanup(func() { os.Stdout = orig })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	f()
+	w.Close()
+	b, _ := io.ReadAll(r)
+	return string(b)
+}
+
+func TestMultiPluginOutputValues(t *testing.T) {
+	captureLog(t)
+	m := NewMultiPlugin(testP{}, failingPlugin{}, testP{})
+	m.Plugins[2].MetricKeyPrefix = "testP2"
+	out := captureStdout(t, m.OutputValues)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var keys []string
+	for _, l := range lines {
+		keys = append(keys, strings.Split(l, "\t")[0])
+	}
+	// The values of a plugin are output in random order.
+	sort.Strings(keys)
+	want := "testP.bar testP.fuga.baz testP2.bar testP2.fuga.baz"
+	if got := strings.Join(keys, " "); got != want {
+		t.Errorf("OutputValues: got %q; want %q", got, want)
+	}
+}
+
+func TestMultiPluginGraphDefinition(t *testing.T) {
+	m := NewMultiPlugin(testP{}, MemcachedPlugin{})
+	graphs, err := m.GraphDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"testP", "testP.fuga", "memcached.cmd"} {
+		if _, ok := graphs[k]; !ok {
+			t.Errorf("GraphDefinition() should contain %s: %v", k, graphs)
+		}
+	}
+
+	m = NewMultiPlugin(testP{}, testP{})
+	if _, err := m.GraphDefinition(); err == nil {
+		t.Error("GraphDefinition() should detect the collision")
+	}
+}
+
+func TestMultiPluginSeparateTempfiles(t *testing.T) {
+	m := NewMultiPlugin(MemcachedPlugin{}, MemcachedPlugin{}, testP{})
+	m.separateTempfiles()
+	seen := make(map[string]bool)
+	for _, h := range m.Plugins {
+		if seen[h.Tempfile] {
+			t.Errorf("Tempfile %s is shared", h.Tempfile)
+		}
+		seen[h.Tempfile] = true
+	}
+
+	// The Tempfiles of the plugins with the prefix do not depend on their positions.
+	a := &MackerelPlugin{Plugin: testP{}, MetricKeyPrefix: "a"}
+	b := &MackerelPlugin{Plugin: testP{}, MetricKeyPrefix: "b"}
+	c := &MackerelPlugin{Plugin: MemcachedPlugin{}}
+	for _, order := range [][]*MackerelPlugin{{a, b, c}, {c, b, a}, {b, c, a}} {
+		for _, h := range order {
+			h.Tempfile = "/tmp/state"
+		}
+		m = &MultiPlugin{Plugins: order}
+		m.separateTempfiles()
+		if a.Tempfile != "/tmp/state-a" || b.Tempfile != "/tmp/state-b" {
+			t.Errorf("Tempfiles = %s, %s; want /tmp/state-a, /tmp/state-b", a.Tempfile, b.Tempfile)
+		}
+		if c.Tempfile == "/tmp/state" || c.Tempfile == a.Tempfile || c.Tempfile == b.Tempfile {
+			t.Errorf("Tempfile %s of the plugin without the prefix is shared", c.Tempfile)
+		}
+	}
+
+	// A Tempfile which is not shared is kept.
+	a.Tempfile, b.Tempfile = "/tmp/a", "/tmp/b"
+	m = &MultiPlugin{Plugins: []*MackerelPlugin{a, b}}
+	m.separateTempfiles()
+	if a.Tempfile != "/tmp/a" || b.Tempfile != "/tmp/b" {
+		t.Errorf("Tempfiles = %s, %s; want them as they are", a.Tempfile, b.Tempfile)
+	}
+}
@@ -0,0 +1,112 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// parseNumber parses s as a value of typ, which is uint32, uint64 or float64.
+//
+// In addition to the formats of strconv, it accepts surrounding spaces, a percent suffix such as "12.5%",
+// thousands separators such as "1,024" and hexadecimal integers such as "0x1f".
+// The error is *strconv.NumError whose Num is s.
+func parseNumber(s string, typ MetricType) (interface{}, error) {
+	t := strings.TrimSpace(s)
+	if strings.HasSuffix(t, "%") {
+		t = strings.TrimSpace(t[:len(t)-1])
+	}
+	switch typ {
+	case Uint32, Uint64:
+		bitSize := 64
+		if typ == Uint32 {
+			bitSize = 32
+		}
+		var n uint64
+		var err error
+		if hex, ok := cutHexPrefix(t); ok {
+			n, err = strconv.ParseUint(hex, 16, bitSize)
+		} else {
+			n, err = strconv.ParseUint(removeThousandsSeparators(t), 10, bitSize)
+		}
+		if err != nil {
+			return nil, numError(s, err)
+		}
+		if typ == Uint32 {
+			return uint32(n), nil
+		}
+		return n, nil
+	default:
+		f, err := strconv.ParseFloat(t, 64)
+		if err == nil {
+			return f, nil
+		}
+		sign, abs := cutSign(t)
+		if hex, ok := cutHexPrefix(abs); ok {
+			n, herr := strconv.ParseUint(hex, 16, 64)
+			if herr != nil {
+				return nil, numError(s, herr)
+			}
+			if sign == "-" {
+				return -float64(n), nil
+			}
+			return float64(n), nil
+		}
+		if u := removeThousandsSeparators(t); u != t {
+			if f, err = strconv.ParseFloat(u, 64); err == nil {
+				return f, nil
+			}
+		}
+		return nil, numError(s, err)
+	}
+}
+
+func numError(s string, err error) error {
+	var ne *strconv.NumError
+	if errors.As(err, &ne) {
+		err = ne.Err
+	}
+	return &strconv.NumError{Func: "parseNumber", Num: s, Err: err}
+}
+
+func cutSign(s string) (string, string) {
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		return s[:1], s[1:]
+	}
+	return "", s
+}
+
+// cutHexPrefix returns s without the prefix "0x" or "0X", and whether s has the prefix.
+func cutHexPrefix(s string) (string, bool) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return s[2:], true
+	}
+	return s, false
+}
+
+// removeThousandsSeparators removes "," in s if they separate the integer part into groups of 3 digits.
+// Otherwise it returns s as is, which is an error to parse.
+func removeThousandsSeparators(s string) string {
+	if !strings.Contains(s, ",") {
+		return s
+	}
+	sign, abs := cutSign(s)
+	integer, fraction, hasFraction := strings.Cut(abs, ".")
+	groups := strings.Split(integer, ",")
+	if len(groups[0]) == 0 || len(groups[0]) > 3 {
+		return s
+	}
+	for _, g := range groups[1:] {
+		if len(g) != 3 {
+			return s
+		}
+	}
+	if strings.Contains(fraction, ",") {
+		return s
+	}
+	r := sign + strings.Join(groups, "")
+	if hasFraction {
+		r += "." + fraction
+	}
+	return r
+}
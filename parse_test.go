@@ -0,0 +1,145 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		s    string
+		typ  MetricType
+		want interface{}
+	}{
+		{"42", Uint64, uint64(42)},
+		{" 42 ", Uint64, uint64(42)},
+		{"42\n", Uint32, uint32(42)},
+		{"1,024", Uint64, uint64(1024)},
+		{"1,234,567", Uint32, uint32(1234567)},
+		{"0x1f", Uint64, uint64(31)},
+		{"0X1F", Uint32, uint32(31)},
+		{"95%", Uint32, uint32(95)},
+		{"12.5", Float64, 12.5},
+		{"12.5%", Float64, 12.5},
+		{" 12.5 % ", Float64, 12.5},
+		{"-1,024.5", Float64, -1024.5},
+		{"0x1f", Float64, 31.0},
+		{"-0x10", Float64, -16.0},
+		{"0x1p-2", Float64, 0.25},
+		{"1e3", "", 1000.0},
+	}
+	for _, tt := range tests {
+		got, err := parseNumber(tt.s, tt.typ)
+		if err != nil {
+			t.Errorf("parseNumber(%q, %q) returns an error: %v", tt.s, tt.typ, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseNumber(%q, %q) = %#v; want %#v", tt.s, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestParseNumberError(t *testing.T) {
+	tests := []struct {
+		s   string
+		typ MetricType
+	}{
+		{"", Uint64},
+		{"abc", Float64},
+		{"12.5", Uint64},
+		{"-1", Uint32},
+		{"4294967296", Uint32},
+		{"1,2", Uint64},
+		{"1234,567", Uint64},
+		{"1,234.5,6", Float64},
+		{"0x", Uint64},
+		{"0xfg", Float64},
+		{"%", Float64},
+	}
+	for _, tt := range tests {
+		got, err := parseNumber(tt.s, tt.typ)
+		var ne *strconv.NumError
+		if !errors.As(err, &ne) || ne.Num != tt.s {
+			t.Errorf("parseNumber(%q, %q) = %#v, %v; want *strconv.NumError", tt.s, tt.typ, got, err)
+		}
+	}
+}
+
+func FuzzParseNumber(f *testing.F) {
+	for _, s := range []string{"42", " 42 ", "12.5%", "1,024", "0x1f", "-0x10", "1e3", "NaN", "-Inf", "1,234,567.89", ""} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, typ := range []MetricType{Uint32, Uint64, Float64} {
+			v, err := parseNumber(s, typ)
+			if err != nil {
+				if v != nil {
+					t.Errorf("parseNumber(%q, %q) returns %#v with an error", s, typ, v)
+				}
+				continue
+			}
+			switch typ {
+			case Uint32:
+				if _, ok := v.(uint32); !ok {
+					t.Errorf("parseNumber(%q, %q) = %#v; want uint32", s, typ, v)
+				}
+			case Uint64:
+				if _, ok := v.(uint64); !ok {
+					t.Errorf("parseNumber(%q, %q) = %#v; want uint64", s, typ, v)
+				}
+			default:
+				if _, ok := v.(float64); !ok {
+					t.Errorf("parseNumber(%q, %q) = %#v; want float64", s, typ, v)
+				}
+			}
+		}
+
+		// parseNumber accepts everything which strconv accepts.
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			if v, err := parseNumber(s, Uint64); err != nil || v != n {
+				t.Errorf("parseNumber(%q, uint64) = %#v, %v; want %d", s, v, err, n)
+			}
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			v, err := parseNumber(s, Float64)
+			if err != nil || !(v == f || math.IsNaN(f) && math.IsNaN(v.(float64))) {
+				t.Errorf("parseNumber(%q, float64) = %#v, %v; want %v", s, v, err, f)
+			}
+		}
+	})
+}
+
+type unparsableP struct {
+	testP
+}
+
+func (unparsableP) FetchMetrics() (map[string]interface{}, error) {
+	return map[string]interface{}{"bar": "n/a", "baz": " 1,024 "}, nil
+}
+
+func TestSkipUnparsableValues(t *testing.T) {
+	captureLog(t)
+	for _, skip := range []bool{false, true} {
+		p := NewMackerelPlugin(unparsableP{})
+		p.SkipUnparsableValues = skip
+		got := make(map[string]interface{})
+		err := p.collectValues(func(key string, value interface{}, now time.Time) {
+			got[key] = value
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"testP.fuga.baz": 1024.0}
+		if !skip {
+			want["testP.bar"] = 0.0
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SkipUnparsableValues=%v: got %v; want %v", skip, got, want)
+		}
+	}
+}
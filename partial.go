@@ -0,0 +1,53 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"strings"
+)
+
+// PartialError is returned by FetchMetrics with the metrics which could be fetched,
+// when the others could not be fetched.
+// The helper outputs and saves the fetched metrics, and logs the error instead of exiting.
+type PartialError struct {
+	Errors []error
+}
+
+// NewPartialError returns *PartialError of the non-nil errors in errs, or nil if there are none.
+func NewPartialError(errs ...error) error {
+	var e PartialError
+	for _, err := range errs {
+		if err != nil {
+			e.Errors = append(e.Errors, err)
+		}
+	}
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return &e
+}
+
+func (e *PartialError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "partially failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors for errors.Is and errors.As.
+func (e *PartialError) Unwrap() []error {
+	return e.Errors
+}
+
+// partialFailures returns the number of the failures if err is *PartialError,
+// in which case the fetched values are still usable.
+func partialFailures(err error) (int, bool) {
+	var e *PartialError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	if len(e.Errors) == 0 {
+		return 1, true
+	}
+	return len(e.Errors), true
+}
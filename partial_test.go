@@ -0,0 +1,86 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errAdminEndpoint = errors.New("admin endpoint is unavailable")
+
+type partialPlugin struct {
+	testP
+	stat map[string]interface{}
+}
+
+func (p partialPlugin) FetchMetrics() (map[string]interface{}, error) {
+	return p.stat, NewPartialError(nil, errAdminEndpoint)
+}
+
+func TestNewPartialError(t *testing.T) {
+	if err := NewPartialError(nil, nil); err != nil {
+		t.Errorf("NewPartialError(nil, nil) = %v; want nil", err)
+	}
+	err := NewPartialError(errAdminEndpoint, nil)
+	var e *PartialError
+	if !errors.As(err, &e) || len(e.Errors) != 1 {
+		t.Fatalf("NewPartialError() = %#v; want *PartialError with an error", err)
+	}
+	if !errors.Is(err, errAdminEndpoint) {
+		t.Errorf("errors.Is(%v, errAdminEndpoint) = false; want true", err)
+	}
+}
+
+func TestCollectValuesWithPartialError(t *testing.T) {
+	p := NewMackerelPlugin(partialPlugin{stat: map[string]interface{}{"bar": 15.0}})
+	p.Tempfile = filepath.Join(t.TempDir(), "state")
+	p.ReportFetchErrors = true
+
+	got := make(map[string]interface{})
+	err := p.collectValues(func(key string, value interface{}, now time.Time) {
+		got[key] = value
+	})
+	if err != nil {
+		t.Fatalf("collectValues() = %v; want nil", err)
+	}
+	want := map[string]interface{}{
+		"testP.bar":                        15.0,
+		"testP.plugin_helper.fetch.errors": 1.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectValues: got %v; want %v", got, want)
+	}
+	if _, ok := p.outputGraphDefinition()["testP.plugin_helper.fetch"]; !ok {
+		t.Error("graph definition of plugin_helper.fetch is not output")
+	}
+}
+
+func TestCollectValuesWithPartialErrorWithoutValues(t *testing.T) {
+	p := NewMackerelPlugin(partialPlugin{})
+	p.Tempfile = filepath.Join(t.TempDir(), "state")
+	err := p.collectValues(func(string, interface{}, time.Time) {})
+	if !errors.Is(err, errAdminEndpoint) {
+		t.Errorf("collectValues() = %v; want %v", err, errAdminEndpoint)
+	}
+}
+
+func TestCollectValuesReportsNoFetchErrors(t *testing.T) {
+	p := NewMackerelPlugin(testP{})
+	p.Tempfile = filepath.Join(t.TempDir(), "state")
+	p.ReportFetchErrors = true
+
+	var errs interface{}
+	err := p.collectValues(func(key string, value interface{}, now time.Time) {
+		if key == "testP.plugin_helper.fetch.errors" {
+			errs = value
+		}
+	})
+	if err != nil {
+		t.Fatalf("collectValues() = %v; want nil", err)
+	}
+	if errs != 0.0 {
+		t.Errorf("plugin_helper.fetch.errors = %v; want 0", errs)
+	}
+}
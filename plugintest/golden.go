@@ -0,0 +1,74 @@
+package plugintest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// EnvUpdateGolden is the environment variable to update golden files instead of comparing with them.
+//
+//	PLUGINTEST_UPDATE_GOLDEN=1 go test ./...
+const EnvUpdateGolden = "PLUGINTEST_UPDATE_GOLDEN"
+
+// FormatCycles returns the output of the cycles, separated by a comment line of each cycle.
+func FormatCycles(cycles ...Cycle) []byte {
+	var b bytes.Buffer
+	for i, c := range cycles {
+		fmt.Fprintf(&b, "# cycle %d at %d\n", i+1, c.Time.Unix())
+		if c.Err != nil {
+			fmt.Fprintf(&b, "# error: %v\n", c.Err)
+		}
+		b.WriteString(c.String())
+	}
+	return b.Bytes()
+}
+
+// FormatDefinitions returns the graph definitions in indented JSON, which is stable to compare.
+func FormatDefinitions(graphs map[string]mp.Graphs) []byte {
+	b, err := json.MarshalIndent(mp.GraphDef{Graphs: graphs}, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// AssertGolden compares got with the content of the golden file at path.
+// If EnvUpdateGolden is set to true, it writes got to the file instead.
+func AssertGolden(t testing.TB, path string, got []byte) {
+	t.Helper()
+	if update, _ := strconv.ParseBool(os.Getenv(EnvUpdateGolden)); update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (set %s=1 to create it)", err, EnvUpdateGolden)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match (set %s=1 to update it)\ngot:\n%s\nwant:\n%s", path, EnvUpdateGolden, got, want)
+	}
+}
+
+// AssertGoldenOutput compares the output of the cycles with the golden file at path.
+func AssertGoldenOutput(t testing.TB, path string, cycles ...Cycle) {
+	t.Helper()
+	AssertGolden(t, path, FormatCycles(cycles...))
+}
+
+// AssertGoldenDefinitions compares the graph definitions with the golden file at path.
+func AssertGoldenDefinitions(t testing.TB, path string, graphs map[string]mp.Graphs) {
+	t.Helper()
+	AssertGolden(t, path, FormatDefinitions(graphs))
+}
@@ -0,0 +1,183 @@
+// Package plugintest runs plugins through simulated cycles for testing them.
+//
+//	func TestMemcached(t *testing.T) {
+//		r := plugintest.New(MemcachedPlugin{Target: addr})
+//		cycles := r.RunCycles(2)
+//		plugintest.AssertGoldenOutput(t, "testdata/memcached.golden", cycles...)
+//		plugintest.AssertGoldenDefinitions(t, "testdata/memcached_def.golden", r.Definitions())
+//	}
+package plugintest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/go-mackerel-plugin-helper/internal/memstate"
+)
+
+// DefaultStart is the time of the first cycle of Runner.
+var DefaultStart = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DefaultInterval is the interval of the cycles of Runner, which is the same as mackerel-agent.
+const DefaultInterval = time.Minute
+
+// Clock is a mackerelplugin.Clock which is advanced manually.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns new Clock whose time is t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the current time of c.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance advances c by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the time of c to t, which may be before the current time.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// MemoryState is a mackerelplugin.StateStore in memory.
+type MemoryState struct {
+	memstate.State
+}
+
+// Metric is a value emitted by a plugin.
+type Metric struct {
+	Key   string
+	Value interface{}
+	Time  time.Time
+}
+
+// Float64 returns the value as float64.
+func (m Metric) Float64() float64 {
+	switch v := m.Value.(type) {
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return math.NaN()
+}
+
+// String returns the line which mackerel-agent receives for m.
+func (m Metric) String() string {
+	switch v := m.Value.(type) {
+	case uint32, uint64:
+		return fmt.Sprintf("%s\t%d\t%d", m.Key, v, m.Time.Unix())
+	case float64:
+		return fmt.Sprintf("%s\t%f\t%d", m.Key, v, m.Time.Unix())
+	}
+	return fmt.Sprintf("%s\t%v\t%d", m.Key, m.Value, m.Time.Unix())
+}
+
+// Cycle is the result of a run of a plugin.
+type Cycle struct {
+	Time time.Time
+	// Metrics are the emitted values sorted by Key.
+	Metrics []Metric
+	Err     error
+}
+
+// Lookup returns the metric of key.
+func (c Cycle) Lookup(key string) (Metric, bool) {
+	i := sort.Search(len(c.Metrics), func(i int) bool { return c.Metrics[i].Key >= key })
+	if i < len(c.Metrics) && c.Metrics[i].Key == key {
+		return c.Metrics[i], true
+	}
+	return Metric{}, false
+}
+
+// String returns the lines which mackerel-agent receives in the cycle.
+// Values which mackerel-agent does not accept, such as NaN, are omitted as the helper does.
+func (c Cycle) String() string {
+	var b strings.Builder
+	for _, m := range c.Metrics {
+		if v, ok := m.Value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			continue
+		}
+		b.WriteString(m.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Runner runs a plugin through simulated cycles, with Clock and MemoryState.
+type Runner struct {
+	Helper *mp.MackerelPlugin
+	Clock  *Clock
+	State  *MemoryState
+
+	// Interval is the duration which Clock is advanced by after each cycle.
+	Interval time.Duration
+}
+
+// New returns new Runner for p, which starts at DefaultStart.
+func New(p mp.Plugin) *Runner {
+	h := mp.NewMackerelPlugin(p)
+	return NewWithHelper(&h)
+}
+
+// NewWithHelper returns new Runner for h, which is configured by the caller.
+// It replaces Clock and StateStore of h.
+func NewWithHelper(h *mp.MackerelPlugin) *Runner {
+	r := &Runner{
+		Helper:   h,
+		Clock:    NewClock(DefaultStart),
+		State:    &MemoryState{},
+		Interval: DefaultInterval,
+	}
+	h.Clock = r.Clock
+	h.StateStore = r.State
+	return r
+}
+
+// Run runs a cycle of the plugin, then advances Clock by Interval.
+func (r *Runner) Run() Cycle {
+	c := Cycle{Time: r.Clock.Now()}
+	c.Err = r.Helper.CollectValues(func(key string, value interface{}, now time.Time) {
+		c.Metrics = append(c.Metrics, Metric{Key: key, Value: value, Time: now})
+	})
+	sort.SliceStable(c.Metrics, func(i, j int) bool {
+		return c.Metrics[i].Key < c.Metrics[j].Key
+	})
+	r.Clock.Advance(r.Interval)
+	return c
+}
+
+// RunCycles runs n cycles of the plugin.
+func (r *Runner) RunCycles(n int) []Cycle {
+	cycles := make([]Cycle, 0, n)
+	for i := 0; i < n; i++ {
+		cycles = append(cycles, r.Run())
+	}
+	return cycles
+}
+
+// Definitions returns the graph definitions which the plugin outputs.
+func (r *Runner) Definitions() map[string]mp.Graphs {
+	return r.Helper.FullGraphDefinition()
+}
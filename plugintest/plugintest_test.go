@@ -0,0 +1,101 @@
+package plugintest
+
+import (
+	"testing"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// counterPlugin returns a counter which is increased by 120 in each cycle.
+type counterPlugin struct {
+	count *uint64
+}
+
+func (p counterPlugin) FetchMetrics() (map[string]interface{}, error) {
+	*p.count += 120
+	return map[string]interface{}{
+		"requests": *p.count,
+		"workers":  4.0,
+	}, nil
+}
+
+func (p counterPlugin) GraphDefinition() map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"requests": {
+			Unit: mp.UnitInteger,
+			Metrics: []mp.Metrics{
+				{Name: "requests", Diff: true, Type: mp.Uint64},
+			},
+		},
+		"workers": {
+			Metrics: []mp.Metrics{
+				{Name: "workers"},
+			},
+		},
+	}
+}
+
+func (p counterPlugin) MetricKeyPrefix() string {
+	return "counter"
+}
+
+func TestRunner(t *testing.T) {
+	r := New(counterPlugin{count: new(uint64)})
+	cycles := r.RunCycles(3)
+
+	for i, c := range cycles {
+		if c.Err != nil {
+			t.Fatalf("cycle %d: %v", i, c.Err)
+		}
+		if want := DefaultStart.Add(time.Duration(i) * DefaultInterval); !c.Time.Equal(want) {
+			t.Errorf("cycle %d: Time = %v; want %v", i, c.Time, want)
+		}
+	}
+	if _, ok := cycles[0].Lookup("counter.requests.requests"); ok {
+		t.Error("the differential is output at the first cycle")
+	}
+	m, ok := cycles[2].Lookup("counter.requests.requests")
+	if !ok {
+		t.Fatal("counter.requests.requests is not output at the third cycle")
+	}
+	if m.Float64() != 120 {
+		t.Errorf("counter.requests.requests = %v; want 120", m.Value)
+	}
+	if _, err := r.State.Load(); err != nil {
+		t.Errorf("state is not saved: %v", err)
+	}
+
+	AssertGoldenOutput(t, "testdata/counter.golden", cycles...)
+	AssertGoldenDefinitions(t, "testdata/counter_def.golden", r.Definitions())
+}
+
+func TestRunnerClockJumps(t *testing.T) {
+	r := New(counterPlugin{count: new(uint64)})
+	r.RunCycles(2)
+
+	// The clock goes backwards: the last values are discarded.
+	r.Clock.Set(DefaultStart.Add(30 * time.Second))
+	c := r.Run()
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	if _, ok := c.Lookup("counter.requests.requests"); ok {
+		t.Error("the differential is output after the clock went backwards")
+	}
+	c = r.Run()
+	if m, ok := c.Lookup("counter.requests.requests"); !ok || m.Float64() != 120 {
+		t.Errorf("counter.requests.requests = %v, %v; want 120", m.Value, ok)
+	}
+
+	// The clock jumps forward: the differential is not output.
+	r.Clock.Advance(time.Hour)
+	c = r.Run()
+	if _, ok := c.Lookup("counter.requests.requests"); ok {
+		t.Error("the differential is output after the clock jumped forward")
+	}
+	c = r.Run()
+	if _, ok := c.Lookup("counter.requests.requests"); !ok {
+		t.Error("the differential is not output after the clock jumped forward")
+	}
+}
@@ -0,0 +1,377 @@
+package mackerelplugin
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusPlugin is Plugin which scrapes metrics in the Prometheus text format from URL or File.
+//
+// A sample is fetched with the key made of its metric name and the values of its labels in the order of the label names,
+// such as "http_requests_total.200.GET" for http_requests_total{code="200",method="GET"},
+// so it is matched by the graph "http_requests_total.#" with the metric "*".
+// The characters in the keys other than letters, digits, "-" and "_" are replaced with "_", and empty labels are "_".
+// The samples of a metric name must have the same number of labels, otherwise the others than the first are reported as errors.
+type PrometheusPlugin struct {
+	// URL is the endpoint to scrape, such as "http://localhost:9100/metrics".
+	URL string
+	// File is the file to read if URL is empty.
+	File string
+	// Prefix is the prefix of the metric keys. The default is "prometheus".
+	Prefix string
+	// Graphs are the graph definitions. If it is nil, they are generated from the scraped samples:
+	// a graph for each metric name with labels, and the graph "" of the prefix for the metrics without labels,
+	// where counters are Diff and Uint64 if their values are integers.
+	Graphs map[string]Graphs
+
+	// Timeout limits the time of the request. Zero means no limit.
+	Timeout time.Duration
+	// Username and Password are used for the basic authentication if Username is not empty.
+	Username string
+	Password string
+	// Header is added to the request.
+	Header http.Header
+	// TLSConfig configures the TLS client.
+	TLSConfig *tls.Config
+
+	mu     sync.Mutex
+	graphs map[string]Graphs // generated from the last scrape
+}
+
+// MetricKeyPrefix returns p.Prefix, or "prometheus" if it is empty.
+// The metrics without labels are output right under the prefix.
+func (p *PrometheusPlugin) MetricKeyPrefix() string {
+	if p.Prefix == "" {
+		return "prometheus"
+	}
+	return p.Prefix
+}
+
+// FetchMetrics scrapes the samples.
+// If some lines cannot be parsed, the parsed values are returned with PartialError.
+func (p *PrometheusPlugin) FetchMetrics() (map[string]interface{}, error) {
+	var samples []promSample
+	var parseErr error
+	read := func(r io.Reader) error {
+		samples, parseErr = parsePrometheusText(r)
+		return nil
+	}
+	if p.URL != "" {
+		req := httpRequest{
+			url:       p.URL,
+			accept:    "text/plain",
+			timeout:   p.Timeout,
+			username:  p.Username,
+			password:  p.Password,
+			header:    p.Header,
+			tlsConfig: p.TLSConfig,
+		}
+		if err := req.do(read); err != nil {
+			return nil, err
+		}
+	} else if p.File != "" {
+		f, err := os.Open(p.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		read(f)
+	} else {
+		return nil, errors.New("neither URL nor File is specified")
+	}
+
+	stat := make(map[string]interface{}, len(samples))
+	errs := []error{parseErr}
+	segments := make(map[string]int)
+	valid := samples[:0:0]
+	for _, s := range samples {
+		if n, ok := segments[s.name]; ok && n != s.segments {
+			// A wildcard of fewer segments would match the keys of more segments.
+			errs = append(errs, fmt.Errorf("%s: %d labels differ from %d labels of the other samples", s.key, s.segments, n))
+			continue
+		}
+		segments[s.name] = s.segments
+		if _, ok := stat[s.key]; ok {
+			errs = append(errs, fmt.Errorf("duplicate key: %s", s.key))
+		}
+		stat[s.key] = s.value
+		valid = append(valid, s)
+	}
+	if p.Graphs == nil {
+		graphs := prometheusGraphs(valid)
+		p.mu.Lock()
+		p.graphs = graphs
+		p.mu.Unlock()
+	}
+	if len(stat) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return stat, NewPartialError(errs...)
+}
+
+// GraphDefinition returns p.Graphs, or the graph definitions generated from the last scrape if p.Graphs is nil.
+// It scrapes the samples if they have not been scraped yet.
+func (p *PrometheusPlugin) GraphDefinition() map[string]Graphs {
+	if p.Graphs != nil {
+		return p.Graphs
+	}
+	p.mu.Lock()
+	graphs := p.graphs
+	p.mu.Unlock()
+	if graphs != nil {
+		return graphs
+	}
+	if _, err := p.FetchMetrics(); err != nil && !errors.As(err, new(*PartialError)) {
+		log.Printf("GraphDefinition: %s\n", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.graphs == nil {
+		// not to scrape again on every call
+		p.graphs = make(map[string]Graphs)
+	}
+	return p.graphs
+}
+
+// Types of Prometheus metrics
+const (
+	promCounter   = "counter"
+	promHistogram = "histogram"
+	promSummary   = "summary"
+)
+
+type promSample struct {
+	name     string // the sanitized metric name
+	segments int    // the number of the label values in key
+	key      string
+	value    string
+	counter  bool
+}
+
+// parsePrometheusText parses the Prometheus text format.
+// It returns the parsed samples with the errors of the lines which cannot be parsed.
+func parsePrometheusText(r io.Reader) ([]promSample, error) {
+	types := make(map[string]string)
+	var samples []promSample
+	var errs []error
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		s, err := parsePromSample(line, types)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w: %q", n, err, line))
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return samples, errors.Join(errs...)
+}
+
+// parsePromSample parses a line of a sample such as `name{label="value"} 1 1700000000000`.
+// The timestamp is ignored.
+func parsePromSample(line string, types map[string]string) (promSample, error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return promSample{}, errors.New("no value")
+	}
+	name, rest := line[:i], line[i:]
+	if !validPromName(name) {
+		return promSample{}, errors.New("invalid metric name")
+	}
+	var labels [][2]string
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		labels, rest, err = parsePromLabels(rest[1:])
+		if err != nil {
+			return promSample{}, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return promSample{}, errors.New("no value")
+	}
+	if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+		return promSample{}, fmt.Errorf("invalid value: %w", err)
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	s := promSample{name: keySegment(name), value: normalizePromValue(fields[0])}
+	s.key = s.name
+	for _, l := range labels {
+		v := keySegment(l[1])
+		if v == "" {
+			// keep the position of the other labels
+			v = "_"
+		}
+		s.key += "." + v
+	}
+	s.segments = len(labels)
+	s.counter = isPromCounter(name, types)
+	return s, nil
+}
+
+func validPromName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_' || r == ':' || i > 0 && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePromLabels parses the labels after "{", and returns them with the rest after "}".
+func parsePromLabels(s string) ([][2]string, string, error) {
+	var labels [][2]string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, "", errors.New("invalid label")
+		}
+		name := strings.TrimSpace(s[:i])
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("label %s: value is not quoted", name)
+		}
+		var value strings.Builder
+		closed := false
+		for i = 1; i < len(s); i++ {
+			c := s[i]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				c = s[i]
+				if c == 'n' {
+					c = '\n'
+				}
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("label %s: value is not terminated", name)
+		}
+		labels = append(labels, [2]string{name, value.String()})
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", errors.New("labels are not terminated")
+		}
+	}
+}
+
+// isPromCounter reports whether the sample of name is a counter,
+// including the buckets, the sums and the counts of histograms and summaries.
+func isPromCounter(name string, types map[string]string) bool {
+	if t, ok := types[name]; ok {
+		return t == promCounter
+	}
+	for _, suffix := range []string{"_total", "_bucket", "_sum", "_count"} {
+		base, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		switch types[base] {
+		case promCounter:
+			return suffix == "_total"
+		case promHistogram, promSummary:
+			return suffix != "_total"
+		}
+	}
+	return false
+}
+
+// normalizePromValue formats an integral value such as "1e+06" without the exponent,
+// so that it can be parsed as Uint64.
+func normalizePromValue(s string) string {
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return s
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f >= math.Ldexp(1, 64) || f != math.Trunc(f) {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// prometheusGraphs generates a graph for each metric name of samples with labels,
+// whose values are matched by the wildcards in the graph key and the metric name.
+// The metrics without labels are put into the graph "", so that their keys are the metric names as they are.
+// The samples of a metric name must have the same number of labels.
+func prometheusGraphs(samples []promSample) map[string]Graphs {
+	type series struct {
+		name     string
+		segments int
+	}
+	metrics := make(map[series]Metrics)
+	var order []series
+	for _, s := range samples {
+		k := series{s.name, s.segments}
+		m, ok := metrics[k]
+		if !ok {
+			order = append(order, k)
+			m = Metrics{Name: s.name, Diff: s.counter, Type: Uint64}
+			if s.segments > 0 {
+				m.Name = "*"
+			}
+		}
+		if !s.counter {
+			m.Diff = false
+		}
+		if _, err := strconv.ParseUint(s.value, 10, 64); err != nil {
+			m.Type = Float64
+		}
+		metrics[k] = m
+	}
+
+	graphs := make(map[string]Graphs)
+	for _, k := range order {
+		m := metrics[k]
+		if !m.Diff {
+			m.Type = Float64
+		}
+		key := ""
+		if k.segments > 0 {
+			key = k.name + strings.Repeat(".#", k.segments-1)
+		}
+		g := graphs[key]
+		g.Metrics = append(g.Metrics, m)
+		graphs[key] = g
+	}
+	return graphs
+}
@@ -0,0 +1,133 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const promText = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} 1027 1395066363000
+http_requests_total{method="POST",code="400"} 3
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 12.47
+# TYPE go_goroutines gauge
+go_goroutines 42
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.5"} 1e+06
+request_duration_seconds_bucket{le="+Inf"} 1.000001e+06
+request_duration_seconds_sum 53423.5
+request_duration_seconds_count 1000001
+rpc_errors{path="/api/v1", instance=""} 1
+escaped{msg="a \"quoted\"\nline, {x}"} 2
+`
+
+func TestParsePrometheusText(t *testing.T) {
+	p := &PrometheusPlugin{File: writePromFile(t, promText)}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"http_requests_total.200.GET":          "1027",
+		"http_requests_total.400.POST":         "3",
+		"process_cpu_seconds_total":            "12.47",
+		"go_goroutines":                        "42",
+		"request_duration_seconds_bucket.0_5":  "1000000",
+		"request_duration_seconds_bucket._Inf": "1000001",
+		"request_duration_seconds_sum":         "53423.5",
+		"request_duration_seconds_count":       "1000001",
+		"rpc_errors._._api_v1":                 "1",
+		"escaped.a__quoted__line___x_":         "2",
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics() = %v; want %v", stat, want)
+	}
+}
+
+func TestParsePrometheusTextErrors(t *testing.T) {
+	p := &PrometheusPlugin{File: writePromFile(t, "ok 1\nbroken\n1bad 2\nlabel{a=\"x} 3\nnan_value{a=\"x\"} abc\n")}
+	stat, err := p.FetchMetrics()
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("FetchMetrics() returns %v; want PartialError", err)
+	}
+	if stat["ok"] != "1" || len(stat) != 1 {
+		t.Errorf("FetchMetrics() = %v; want only ok", stat)
+	}
+
+	p.File = writePromFile(t, "broken\n")
+	if _, err := p.FetchMetrics(); err == nil || errors.As(err, &partial) {
+		t.Errorf("FetchMetrics() returns %v; want an error which is not PartialError", err)
+	}
+}
+
+func TestPrometheusGraphs(t *testing.T) {
+	p := &PrometheusPlugin{File: writePromFile(t, promText)}
+	got := p.GraphDefinition()
+	want := map[string]Graphs{
+		"http_requests_total.#": {Metrics: []Metrics{{Name: "*", Diff: true, Type: Uint64}}},
+		"": {Metrics: []Metrics{
+			{Name: "process_cpu_seconds_total", Diff: true, Type: Float64},
+			{Name: "go_goroutines", Type: Float64},
+			{Name: "request_duration_seconds_sum", Diff: true, Type: Float64},
+			{Name: "request_duration_seconds_count", Diff: true, Type: Uint64},
+		}},
+		"request_duration_seconds_bucket": {Metrics: []Metrics{{Name: "*", Diff: true, Type: Uint64}}},
+		"rpc_errors.#":                    {Metrics: []Metrics{{Name: "*", Type: Float64}}},
+		"escaped":                         {Metrics: []Metrics{{Name: "*", Type: Float64}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GraphDefinition() = %v; want %v", got, want)
+	}
+	for key, graph := range got {
+		if err := validateGraph(key, graph); err != nil {
+			t.Errorf("generated graph is invalid: %v", err)
+		}
+	}
+}
+
+func TestPrometheusMixedLabels(t *testing.T) {
+	p := &PrometheusPlugin{File: writePromFile(t, `mixed{a="x"} 1
+mixed{a="x",b="y"} 2
+mixed{a="z"} 3
+`)}
+	stat, err := p.FetchMetrics()
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("FetchMetrics() returns %v; want PartialError", err)
+	}
+	want := map[string]interface{}{"mixed.x": "1", "mixed.z": "3"}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("FetchMetrics() = %v; want %v", stat, want)
+	}
+	if got, want := p.GraphDefinition(), map[string]Graphs{"mixed": {Metrics: []Metrics{{Name: "*", Type: Float64}}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GraphDefinition() = %v; want %v", got, want)
+	}
+}
+
+func TestPrometheusPluginDefaultPrefix(t *testing.T) {
+	h := NewMackerelPlugin(&PrometheusPlugin{File: writePromFile(t, "go_goroutines 42\n")})
+	graphs := h.outputGraphDefinition()
+	if _, ok := graphs[""]; ok {
+		t.Errorf("graph without the name is defined: %v", graphs)
+	}
+	if g, ok := graphs["prometheus"]; !ok || len(g.Metrics) != 1 || g.Metrics[0].Name != "go_goroutines" {
+		t.Errorf("graph prometheus of go_goroutines is not defined: %v", graphs)
+	}
+	if key := h.metricKey("", "go_goroutines"); key != "prometheus.go_goroutines" {
+		t.Errorf("metric key = %s; want prometheus.go_goroutines", key)
+	}
+}
+
+func writePromFile(t *testing.T, s string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "metrics.prom")
+	if err := os.WriteFile(name, []byte(s), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
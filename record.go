@@ -0,0 +1,213 @@
+package mackerelplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/mackerelio/go-mackerel-plugin-helper/internal/memstate"
+)
+
+// record is a result of FetchMetrics, which is written in a line of the record file as JSON.
+type record struct {
+	Time   time.Time                `json:"time"`
+	Values map[string]recordedValue `json:"values"`
+	Seen   map[string]time.Time     `json:"seen,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+	// Partial reports whether Error is PartialError.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// recordedValue is a fetched value with its type, so that it is replayed as is.
+type recordedValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// unsupportedValue is replayed for a value of a type which the helper does not support, which is regarded as 0.
+type unsupportedValue string
+
+func newRecordedValue(v interface{}) recordedValue {
+	switch v := v.(type) {
+	case nil:
+		return recordedValue{Type: "nil"}
+	case uint32:
+		return recordedValue{Type: "uint32", Value: strconv.FormatUint(uint64(v), 10)}
+	case uint64:
+		return recordedValue{Type: "uint64", Value: strconv.FormatUint(v, 10)}
+	case float64:
+		return recordedValue{Type: "float64", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+	case string:
+		return recordedValue{Type: "string", Value: v}
+	}
+	return recordedValue{Type: fmt.Sprintf("%T", v), Value: fmt.Sprint(v)}
+}
+
+func (r recordedValue) value() (interface{}, error) {
+	switch r.Type {
+	case "nil":
+		return nil, nil
+	case "uint32":
+		v, err := strconv.ParseUint(r.Value, 10, 32)
+		return uint32(v), err
+	case "uint64":
+		return strconv.ParseUint(r.Value, 10, 64)
+	case "float64":
+		return strconv.ParseFloat(r.Value, 64)
+	case "string":
+		return r.Value, nil
+	}
+	return unsupportedValue(r.Value), nil
+}
+
+// RecordPlugin returns Plugin which writes the results of p.FetchMetrics and their times to w, a line for each.
+// The records are replayed by Replay.
+// If p implements MetricKeyPrefix, the result implements PluginWithPrefix.
+func RecordPlugin(p Plugin, w io.Writer) Plugin {
+	r := &recorder{Plugin: p, w: w}
+	if pp, ok := p.(PluginWithPrefix); ok {
+		return &recorderWithPrefix{recorder: r, prefix: pp.MetricKeyPrefix}
+	}
+	return r
+}
+
+type recorder struct {
+	Plugin
+	w    io.Writer
+	seen map[string]time.Time
+	now  time.Time // the time of the fetch given by the helper, which is set by setFetchTime
+}
+
+func (r *recorder) FetchMetrics() (map[string]interface{}, error) {
+	stat, err := r.Plugin.FetchMetrics()
+	now := r.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	rec := record{Time: now, Values: make(map[string]recordedValue, len(stat))}
+	for k, v := range stat {
+		rec.Values[k] = newRecordedValue(v)
+	}
+	r.seen = nil
+	if p, ok := r.Plugin.(timestampedPlugin); ok {
+		r.seen = p.timestamps()
+		rec.Seen = r.seen
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		_, rec.Partial = partialFailures(err)
+	}
+	b, merr := json.Marshal(rec)
+	if merr == nil {
+		_, merr = r.w.Write(append(b, '\n'))
+	}
+	if merr != nil {
+		log.Println("RecordPlugin: ", merr)
+	}
+	return stat, err
+}
+
+func (r *recorder) timestamps() map[string]time.Time {
+	return r.seen
+}
+
+func (r *recorder) setFetchTime(now time.Time) {
+	r.now = now
+}
+
+type recorderWithPrefix struct {
+	*recorder
+	prefix func() string
+}
+
+func (r *recorderWithPrefix) MetricKeyPrefix() string {
+	return r.prefix()
+}
+
+// Replay runs h through the records read from r, as if h.FetchMetrics returned them at the recorded times,
+// and passes each computed value to output.
+// The graph definitions are given by h, and the state is kept in memory unless h.StateStore is set,
+// so that the differentials, the resets and the overflows are reproduced as they were.
+// Errors in the records are logged, and it returns an error only if the records cannot be read.
+func Replay(h *MackerelPlugin, r io.Reader, output func(key string, value interface{}, now time.Time)) error {
+	rp := &replayer{Plugin: h.Plugin}
+	clock := &replayClock{}
+	hh := *h
+	hh.Plugin = rp
+	if pp, ok := h.Plugin.(PluginWithPrefix); ok {
+		hh.Plugin = &replayerWithPrefix{replayer: rp, prefix: pp.MetricKeyPrefix}
+	}
+	hh.Clock = clock
+	if hh.StateStore == nil {
+		hh.StateStore = &memstate.State{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		stat := make(map[string]interface{}, len(rec.Values))
+		for k, v := range rec.Values {
+			value, err := v.value()
+			if err != nil {
+				return fmt.Errorf("line %d: %s: %w", n, k, err)
+			}
+			stat[k] = value
+		}
+		rp.stat, rp.seen, rp.err = stat, rec.Seen, nil
+		if rec.Error != "" {
+			rp.err = errors.New(rec.Error)
+			if rec.Partial {
+				rp.err = NewPartialError(rp.err)
+			}
+		}
+		clock.now = rec.Time
+		if err := hh.collectValues(output); err != nil {
+			log.Printf("Replay: record at %d: %v\n", rec.Time.Unix(), err)
+		}
+	}
+	return scanner.Err()
+}
+
+type replayer struct {
+	Plugin
+	stat map[string]interface{}
+	seen map[string]time.Time
+	err  error
+}
+
+func (r *replayer) FetchMetrics() (map[string]interface{}, error) {
+	return r.stat, r.err
+}
+
+func (r *replayer) timestamps() map[string]time.Time {
+	return r.seen
+}
+
+type replayerWithPrefix struct {
+	*replayer
+	prefix func() string
+}
+
+func (r *replayerWithPrefix) MetricKeyPrefix() string {
+	return r.prefix()
+}
+
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,133 @@
+package mackerelplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordP struct {
+	stat map[string]interface{}
+	err  error
+}
+
+func (p recordP) FetchMetrics() (map[string]interface{}, error) {
+	return p.stat, p.err
+}
+
+func (p recordP) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"cmd": {
+			Metrics: []Metrics{
+				{Name: "cmd_get", Diff: true, Type: Uint64},
+				{Name: "cmd_set", Diff: true, Type: Uint32},
+			},
+		},
+	}
+}
+
+func (p recordP) MetricKeyPrefix() string {
+	return "rec"
+}
+
+func TestRecordPlugin(t *testing.T) {
+	stat := map[string]interface{}{
+		"cmd_get": uint64(math.MaxUint64 - 1),
+		"cmd_set": uint32(10),
+		"ratio":   0.25,
+		"version": "1.6.21",
+		"nan":     math.NaN(),
+		"int":     3,
+		"none":    nil,
+	}
+	var buf bytes.Buffer
+	p := RecordPlugin(recordP{stat: stat, err: NewPartialError(errors.New("slabs failed"))}, &buf)
+	if _, ok := p.(PluginWithPrefix); !ok {
+		t.Error("RecordPlugin does not keep MetricKeyPrefix")
+	}
+	got, err := p.FetchMetrics()
+	if !reflect.DeepEqual(got, stat) && err == nil {
+		t.Fatalf("FetchMetrics() = %v, %v; want the result of the plugin", got, err)
+	}
+
+	var rec record
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Error == "" || !rec.Partial {
+		t.Errorf("the error is not recorded as partial: %+v", rec)
+	}
+	for k, v := range stat {
+		replayed, err := rec.Values[k].value()
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+			continue
+		}
+		switch k {
+		case "nan":
+			if f, ok := replayed.(float64); !ok || !math.IsNaN(f) {
+				t.Errorf("%s: replayed %#v; want NaN", k, replayed)
+			}
+		case "int":
+			if replayed != unsupportedValue("3") {
+				t.Errorf("%s: replayed %#v; want unsupportedValue", k, replayed)
+			}
+		default:
+			if replayed != v {
+				t.Errorf("%s: replayed %#v; want %#v", k, replayed, v)
+			}
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records := strings.Join([]string{
+		`{"time":"2024-01-01T00:00:00Z","values":{"cmd_get":{"type":"uint64","value":"18446744073709551495"},"cmd_set":{"type":"uint32","value":"100"}}}`,
+		`{"time":"2024-01-01T00:01:00Z","values":{"cmd_get":{"type":"uint64","value":"18446744073709551555"},"cmd_set":{"type":"uint32","value":"160"}}}`,
+		// cmd_get overflows
+		`{"time":"2024-01-01T00:02:00Z","values":{"cmd_get":{"type":"uint64","value":"4"},"cmd_set":{"type":"uint32","value":"220"}}}`,
+		`{"time":"2024-01-01T00:03:00Z","values":{},"error":"connection refused"}`,
+		// cmd_set is reset
+		`{"time":"2024-01-01T00:04:00Z","values":{"cmd_get":{"type":"uint64","value":"124"},"cmd_set":{"type":"uint32","value":"1"}}}`,
+		"",
+	}, "\n")
+	captureLog(t)
+
+	h := NewMackerelPlugin(recordP{})
+	var got []string
+	err := Replay(&h, strings.NewReader(records), func(key string, value interface{}, now time.Time) {
+		got = append(got, fmt.Sprintf("%s %s=%v", now.UTC().Format("15:04"), key, value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"00:01 rec.cmd.cmd_get=60",
+		"00:01 rec.cmd.cmd_set=60",
+		"00:02 rec.cmd.cmd_get=65",
+		"00:02 rec.cmd.cmd_set=60",
+		"00:04 rec.cmd.cmd_get=60",
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay: got %v; want %v", got, want)
+	}
+	if h.Clock != nil || h.StateStore != nil {
+		t.Error("Replay modifies the helper")
+	}
+}
+
+func TestReplayInvalidRecord(t *testing.T) {
+	h := NewMackerelPlugin(recordP{})
+	err := Replay(&h, strings.NewReader("{\n"), func(string, interface{}, time.Time) {})
+	if err == nil {
+		t.Error("Replay should return an error for an invalid record")
+	}
+}
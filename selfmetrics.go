@@ -0,0 +1,108 @@
+package mackerelplugin
+
+import "time"
+
+const selfGraphKey = "plugin_helper.self"
+
+// Reasons why values are skipped, which are the names of the metrics of plugin_helper.self.skipped.
+const (
+	skipMissing      = "missing"
+	skipReset        = "reset"
+	skipParseError   = "parse_error"
+	skipInvalidFloat = "invalid_float"
+)
+
+var skipReasons = []string{skipMissing, skipReset, skipParseError, skipInvalidFloat}
+
+// selfStats records the metrics about the plugin itself in a run.
+// All methods of nil *selfStats do nothing, so that callers need not check whether SelfMetrics is enabled.
+type selfStats struct {
+	fetchDuration time.Duration
+	fetchedKeys   int
+	emittedLines  int
+	skipped       map[string]int
+	stateSize     int
+}
+
+func (s *selfStats) emit() {
+	if s == nil {
+		return
+	}
+	s.emittedLines++
+}
+
+func (s *selfStats) stored(size int) {
+	if s == nil {
+		return
+	}
+	s.stateSize = size
+}
+
+func (s *selfStats) skip(reason string) {
+	if s == nil {
+		return
+	}
+	if s.skipped == nil {
+		s.skipped = make(map[string]int)
+	}
+	s.skipped[reason]++
+}
+
+// outputSelfMetrics outputs the metrics recorded in h.stats.
+// Lines emitted by outputSelfMetrics itself are not counted.
+func (h *MackerelPlugin) outputSelfMetrics(now time.Time) {
+	s := h.stats
+	if s == nil {
+		return
+	}
+	h.stats = nil
+	h.outputValue(h.metricKey(selfGraphKey+".fetch", "duration"), s.fetchDuration.Seconds(), now)
+	h.outputValue(h.metricKey(selfGraphKey+".series", "fetched_keys"), float64(s.fetchedKeys), now)
+	h.outputValue(h.metricKey(selfGraphKey+".series", "emitted_lines"), float64(s.emittedLines), now)
+	for _, reason := range skipReasons {
+		h.outputValue(h.metricKey(selfGraphKey+".skipped", reason), float64(s.skipped[reason]), now)
+	}
+	if h.hasDiff() {
+		h.outputValue(h.metricKey(selfGraphKey+".state", "file_size"), float64(s.stateSize), now)
+	}
+}
+
+// selfGraphDefinition returns the definitions of the graphs of the metrics about the plugin itself.
+func (h *MackerelPlugin) selfGraphDefinition() map[string]Graphs {
+	skipped := make([]Metrics, 0, len(skipReasons))
+	for _, reason := range skipReasons {
+		skipped = append(skipped, Metrics{Name: reason, Stacked: true})
+	}
+	graphs := map[string]Graphs{
+		selfGraphKey + ".fetch": {
+			Label: "Plugin FetchMetrics Duration",
+			Unit:  UnitSeconds,
+			Metrics: []Metrics{
+				{Name: "duration", Label: "Duration"},
+			},
+		},
+		selfGraphKey + ".series": {
+			Label: "Plugin Series",
+			Unit:  UnitInteger,
+			Metrics: []Metrics{
+				{Name: "fetched_keys", Label: "Fetched Keys"},
+				{Name: "emitted_lines", Label: "Emitted Lines"},
+			},
+		},
+		selfGraphKey + ".skipped": {
+			Label:   "Plugin Skipped Metrics",
+			Unit:    UnitInteger,
+			Metrics: skipped,
+		},
+	}
+	if h.hasDiff() {
+		graphs[selfGraphKey+".state"] = Graphs{
+			Label: "Plugin State File",
+			Unit:  UnitBytes,
+			Metrics: []Metrics{
+				{Name: "file_size", Label: "File Size"},
+			},
+		}
+	}
+	return graphs
+}
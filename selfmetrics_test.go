@@ -0,0 +1,107 @@
+package mackerelplugin
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type selfP struct{}
+
+func (selfP) FetchMetrics() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"requests": 120.0,
+		"reset":    5.0,
+		"broken":   "abc",
+		"ratio":    math.NaN(),
+	}, nil
+}
+
+func (selfP) GraphDefinition() map[string]Graphs {
+	return map[string]Graphs{
+		"app": {
+			Metrics: []Metrics{
+				{Name: "requests", Diff: true},
+				{Name: "reset", Diff: true},
+				{Name: "broken"},
+				{Name: "ratio"},
+				{Name: "absent"},
+			},
+		},
+	}
+}
+
+func (selfP) MetricKeyPrefix() string {
+	return "self"
+}
+
+func TestSelfMetrics(t *testing.T) {
+	p := NewMackerelPlugin(selfP{})
+	p.Tempfile = filepath.Join(t.TempDir(), "state")
+	p.SelfMetrics = true
+	last := time.Now().Add(-time.Minute).Unix()
+	state := fmt.Sprintf(`{"version":2,"lastTime":%d,"values":{"requests":60,"reset":10}}`, last)
+	if err := os.WriteFile(p.Tempfile, []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]interface{})
+	err := p.collectValues(func(key string, value interface{}, now time.Time) {
+		got[key] = value
+	})
+	if err != nil {
+		t.Fatalf("collectValues() = %v; want nil", err)
+	}
+	fi, err := os.Stat(p.Tempfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := got["self.plugin_helper.self.fetch.duration"].(float64); !ok || d < 0 {
+		t.Errorf("plugin_helper.self.fetch.duration = %v; want a non-negative float64", got["self.plugin_helper.self.fetch.duration"])
+	}
+	want := map[string]interface{}{
+		"self.plugin_helper.self.series.fetched_keys":   4.0,
+		"self.plugin_helper.self.series.emitted_lines":  2.0, // requests, and broken as 0
+		"self.plugin_helper.self.skipped.missing":       1.0,
+		"self.plugin_helper.self.skipped.reset":         1.0,
+		"self.plugin_helper.self.skipped.parse_error":   1.0,
+		"self.plugin_helper.self.skipped.invalid_float": 1.0,
+		"self.plugin_helper.self.state.file_size":       float64(fi.Size()),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v; want %v", k, got[k], v)
+		}
+	}
+
+	var keys []string
+	for k := range p.outputGraphDefinition() {
+		keys = append(keys, k)
+	}
+	for _, k := range []string{"self.plugin_helper.self.fetch", "self.plugin_helper.self.series", "self.plugin_helper.self.skipped", "self.plugin_helper.self.state"} {
+		if _, ok := p.outputGraphDefinition()[k]; !ok {
+			t.Errorf("graph definition of %s is not output: %v", k, keys)
+		}
+	}
+}
+
+func TestSelfMetricsDisabled(t *testing.T) {
+	p := NewMackerelPlugin(testP{})
+	p.Tempfile = filepath.Join(t.TempDir(), "state")
+	var keys []string
+	err := p.collectValues(func(key string, value interface{}, now time.Time) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		t.Fatalf("collectValues() = %v; want nil", err)
+	}
+	sort.Strings(keys)
+	if want := []string{"testP.bar", "testP.fuga.baz"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("collectValues: got %v; want %v", keys, want)
+	}
+}
@@ -0,0 +1,135 @@
+package mackerelplugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultStatsMaxSize is the limit of the size of stats read by StatsParser if MaxSize is zero.
+const DefaultStatsMaxSize = 1024 * 1024
+
+// StatsParser parses a stream of lines of keys and values, such as the stats of memcached or INFO of redis,
+// into the values to return from FetchMetrics.
+// The values are kept as strings so that they are parsed in Type of the metrics.
+type StatsParser struct {
+	// Delimiter separates a key and a value, such as ":". If it is empty, they are separated by spaces or tabs.
+	Delimiter string
+	// Prefix is the token which lines of stats begin with, such as "STAT". If it is set, the other lines are ignored.
+	Prefix string
+	// Terminator is the line which ends the stats, such as "END".
+	// If it is set, the parser stops reading at it, and it is an error if the stream ends before it.
+	Terminator string
+	// SectionPrefix begins the lines of section headers, such as "#" of "# Server".
+	SectionPrefix string
+	// SectionKeys prefixes the keys with the lowercase section name, such as "server.uptime_in_seconds".
+	SectionKeys bool
+	// MaxSize limits the size of the stats in bytes. Zero means DefaultStatsMaxSize.
+	MaxSize int
+}
+
+// Parsers of well-known formats
+var (
+	// MemcachedStats parses the response of the "stats" command of memcached.
+	MemcachedStats = StatsParser{Prefix: "STAT", Terminator: "END"}
+	// RedisInfo parses the response of the INFO command of redis.
+	RedisInfo = StatsParser{Delimiter: ":", SectionPrefix: "#"}
+)
+
+// Parse reads the stats from r.
+// If some lines cannot be parsed, the parsed values are returned with PartialError.
+func (p StatsParser) Parse(r io.Reader) (map[string]interface{}, error) {
+	maxSize := p.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultStatsMaxSize
+	}
+	stat := make(map[string]interface{})
+	var errs []error
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSize)
+	terminated := false
+	section := ""
+	size := 0
+	for n := 1; scanner.Scan(); n++ {
+		size += len(scanner.Bytes()) + 1
+		if size > maxSize {
+			errs = append(errs, fmt.Errorf("stats exceed %d bytes", maxSize))
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if p.Terminator != "" && line == p.Terminator {
+			terminated = true
+			break
+		}
+		if line == "" {
+			continue
+		}
+		if p.SectionPrefix != "" && strings.HasPrefix(line, p.SectionPrefix) {
+			section = keySegment(strings.ToLower(strings.TrimSpace(line[len(p.SectionPrefix):])))
+			continue
+		}
+		if p.Prefix != "" {
+			rest, ok := cutToken(line, p.Prefix)
+			if !ok {
+				continue
+			}
+			line = rest
+		}
+		key, value, err := p.splitLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w: %q", n, err, line))
+			continue
+		}
+		if value == "" {
+			// such as "config_file:" of redis
+			continue
+		}
+		if p.SectionKeys && section != "" {
+			key = section + "." + key
+		}
+		stat[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	} else if p.Terminator != "" && !terminated && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("stats end without %q: %w", p.Terminator, io.ErrUnexpectedEOF))
+	}
+	if len(stat) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return stat, NewPartialError(errs...)
+}
+
+func (p StatsParser) splitLine(line string) (string, string, error) {
+	var key, value string
+	if p.Delimiter == "" {
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return "", "", errors.New("no value")
+		}
+		key, value = line[:i], line[i:]
+	} else {
+		var ok bool
+		key, value, ok = strings.Cut(line, p.Delimiter)
+		if !ok {
+			return "", "", fmt.Errorf("no delimiter %q", p.Delimiter)
+		}
+	}
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if key == "" {
+		return "", "", errors.New("no key")
+	}
+	return key, value, nil
+}
+
+// cutToken returns s without the token and the following spaces, and whether s begins with the token.
+func cutToken(s, token string) (string, bool) {
+	rest, ok := strings.CutPrefix(s, token)
+	if !ok || rest == "" || rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+	return strings.TrimLeft(rest, " \t"), true
+}
@@ -0,0 +1,90 @@
+package mackerelplugin
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatsParserMemcached(t *testing.T) {
+	in := "STAT pid 1994\r\nSTAT version 1.4.0\r\nSTAT  cmd_get\t4306259844\r\nSTAT broken\r\nSTATS x 1\r\nEND\r\nSTAT after 1\r\n"
+	stat, err := MemcachedStats.Parse(strings.NewReader(in))
+	var partial *PartialError
+	if !errors.As(err, &partial) || len(partial.Errors) != 1 {
+		t.Errorf("Parse() returns %v; want PartialError of the broken line", err)
+	}
+	want := map[string]interface{}{"pid": "1994", "version": "1.4.0", "cmd_get": "4306259844"}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("Parse() = %v; want %v", stat, want)
+	}
+}
+
+func TestStatsParserTerminator(t *testing.T) {
+	stat, err := MemcachedStats.Parse(strings.NewReader("STAT pid 1994\n"))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Parse() returns %v; want io.ErrUnexpectedEOF", err)
+	}
+	if stat["pid"] != "1994" {
+		t.Errorf("Parse() = %v; want pid", stat)
+	}
+
+	if _, err := MemcachedStats.Parse(strings.NewReader("ERROR\r\n")); err == nil {
+		t.Error("Parse() should return an error without the terminator")
+	}
+}
+
+func TestStatsParserRedis(t *testing.T) {
+	in := "# Server\r\nredis_version:7.2.4\r\nconfig_file:\r\nuptime_in_seconds:3600\r\n\r\n# Keyspace\r\ndb0:keys=10,expires=2\r\n"
+	stat, err := RedisInfo.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"redis_version":     "7.2.4",
+		"uptime_in_seconds": "3600",
+		"db0":               "keys=10,expires=2",
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("Parse() = %v; want %v", stat, want)
+	}
+
+	p := RedisInfo
+	p.SectionKeys = true
+	stat, err = p.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{
+		"server.redis_version":     "7.2.4",
+		"server.uptime_in_seconds": "3600",
+		"keyspace.db0":             "keys=10,expires=2",
+	}
+	if !reflect.DeepEqual(stat, want) {
+		t.Errorf("Parse() with SectionKeys = %v; want %v", stat, want)
+	}
+}
+
+func TestStatsParserMaxSize(t *testing.T) {
+	p := StatsParser{MaxSize: 16}
+	stat, err := p.Parse(strings.NewReader("a 1\nb 2\nlong_key 12345\n"))
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Errorf("Parse() returns %v; want PartialError", err)
+	}
+	if want := map[string]interface{}{"a": "1", "b": "2"}; !reflect.DeepEqual(stat, want) {
+		t.Errorf("Parse() = %v; want %v", stat, want)
+	}
+
+	if _, err := p.Parse(strings.NewReader(strings.Repeat("x", 100))); err == nil {
+		t.Error("Parse() should return an error for a too long line")
+	}
+}
+
+func TestStatsParserEmpty(t *testing.T) {
+	stat, err := StatsParser{}.Parse(strings.NewReader(""))
+	if err != nil || len(stat) != 0 {
+		t.Errorf("Parse() = %v, %v; want no values and no error", stat, err)
+	}
+}
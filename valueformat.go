@@ -0,0 +1,112 @@
+package mackerelplugin
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValueFormat is the format of string values of a metric.
+type ValueFormat string
+
+// Formats of string values
+const (
+	// ValueFormatNumber is plain numbers, which is the default.
+	ValueFormatNumber ValueFormat = ""
+	// ValueFormatBytes is sizes such as "512M", "1.5GiB" or "100kB", which are parsed into bytes.
+	// All the suffixes are powers of 1024, so "K", "KB", "Ki" and "KiB" are the same.
+	ValueFormatBytes ValueFormat = "bytes"
+	// ValueFormatDuration is durations such as "250ms" or "3h2m", which are parsed into seconds.
+	// A number without a unit is regarded as seconds.
+	ValueFormatDuration ValueFormat = "duration"
+)
+
+func (f ValueFormat) valid() bool {
+	switch f {
+	case ValueFormatNumber, ValueFormatBytes, ValueFormatDuration:
+		return true
+	}
+	return false
+}
+
+// parseMetricValue parses s in ValueFormat and Type of metric.
+// Sizes and durations of integer types are rounded to the nearest integer.
+func parseMetricValue(s string, metric Metrics) (interface{}, error) {
+	var f float64
+	var err error
+	switch metric.ValueFormat {
+	case ValueFormatBytes:
+		f, err = parseBytes(s)
+	case ValueFormatDuration:
+		f, err = parseDurationSeconds(s)
+	default:
+		return parseNumber(s, metric.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch metric.Type {
+	case Uint32, Uint64:
+		limit := math.Ldexp(1, 64)
+		if metric.Type == Uint32 {
+			limit = math.Ldexp(1, 32)
+		}
+		r := math.Round(f)
+		if !(0 <= r && r < limit) {
+			return nil, &strconv.NumError{Func: "parseMetricValue", Num: s, Err: strconv.ErrRange}
+		}
+		if metric.Type == Uint32 {
+			return uint32(r), nil
+		}
+		return uint64(r), nil
+	}
+	return f, nil
+}
+
+// byteUnits are the multipliers of the lowercase suffixes of sizes.
+// "K", "KB", "Ki" and "KiB" are all 1024, as memcached, redis and most tools which report sizes mean.
+var byteUnits = func() map[string]float64 {
+	units := map[string]float64{"": 1, "b": 1}
+	for i, p := range []string{"k", "m", "g", "t", "p", "e"} {
+		mul := math.Ldexp(1, 10*(i+1))
+		for _, suffix := range []string{"", "b", "i", "ib"} {
+			units[p+suffix] = mul
+		}
+	}
+	return units
+}()
+
+// parseBytes parses s as a size, and returns it in bytes.
+func parseBytes(s string) (float64, error) {
+	t := strings.TrimSpace(s)
+	i := strings.IndexFunc(t, func(r rune) bool {
+		return !('0' <= r && r <= '9' || r == '.' || r == ',' || r == '+' || r == '-')
+	})
+	num, unit := t, ""
+	if i >= 0 {
+		num, unit = t[:i], strings.TrimSpace(t[i:])
+	}
+	mul, ok := byteUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, &strconv.NumError{Func: "parseBytes", Num: s, Err: strconv.ErrSyntax}
+	}
+	v, err := parseNumber(num, Float64)
+	if err != nil {
+		return 0, &strconv.NumError{Func: "parseBytes", Num: s, Err: strconv.ErrSyntax}
+	}
+	return v.(float64) * mul, nil
+}
+
+// parseDurationSeconds parses s as a duration, and returns it in seconds.
+func parseDurationSeconds(s string) (float64, error) {
+	t := strings.TrimSpace(s)
+	if v, err := parseNumber(t, Float64); err == nil {
+		return v.(float64), nil
+	}
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, &strconv.NumError{Func: "parseDurationSeconds", Num: s, Err: strconv.ErrSyntax}
+	}
+	return d.Seconds(), nil
+}
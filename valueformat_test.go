@@ -0,0 +1,53 @@
+package mackerelplugin
+
+import "testing"
+
+func TestParseMetricValue(t *testing.T) {
+	tests := []struct {
+		s      string
+		metric Metrics
+		want   interface{}
+	}{
+		{"512M", Metrics{ValueFormat: ValueFormatBytes}, 512.0 * 1024 * 1024},
+		{"512m", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(512 * 1024 * 1024)},
+		{"1.5GiB", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1536 * 1024 * 1024)},
+		{"100kB", Metrics{ValueFormat: ValueFormatBytes}, 102400.0},
+		{"1K", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1024)},
+		{"1KB", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1024)},
+		{"1Ki", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1024)},
+		{"1KiB", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1024)},
+		{" 2 MB ", Metrics{ValueFormat: ValueFormatBytes}, 2.0 * 1024 * 1024},
+		{"1,024", Metrics{ValueFormat: ValueFormatBytes, Type: Uint32}, uint32(1024)},
+		{"1.1K", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}, uint64(1126)},
+		{"250ms", Metrics{ValueFormat: ValueFormatDuration}, 0.25},
+		{"3h2m", Metrics{ValueFormat: ValueFormatDuration, Type: Uint32}, uint32(10920)},
+		{"1.5", Metrics{ValueFormat: ValueFormatDuration}, 1.5},
+		{"42", Metrics{}, 42.0},
+	}
+	for _, tt := range tests {
+		got, err := parseMetricValue(tt.s, tt.metric)
+		if err != nil {
+			t.Errorf("parseMetricValue(%q, %q) returns an error: %v", tt.s, tt.metric.ValueFormat, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMetricValue(%q, %q) = %#v; want %#v", tt.s, tt.metric.ValueFormat, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		s      string
+		metric Metrics
+	}{
+		{"12X", Metrics{ValueFormat: ValueFormatBytes}},
+		{"MB", Metrics{ValueFormat: ValueFormatBytes}},
+		{"-1K", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}},
+		{"16EiB", Metrics{ValueFormat: ValueFormatBytes, Type: Uint64}},
+		{"5G", Metrics{ValueFormat: ValueFormatBytes, Type: Uint32}},
+		{"3 days", Metrics{ValueFormat: ValueFormatDuration}},
+	} {
+		if got, err := parseMetricValue(tt.s, tt.metric); err == nil {
+			t.Errorf("parseMetricValue(%q, %q) = %#v; want an error", tt.s, tt.metric.ValueFormat, got)
+		}
+	}
+}